@@ -1,3 +1,20 @@
 #!/bin/bash
+# Builds nar executable and installs it to $NAR_HOME/bin (default: ~/.nar/bin).
+# Runtime headers and library are resolved by cgo with pkg-config (nar-runtime-c package).
+# If NAR_HOME is set or the package is not installed, they are taken from $NAR_HOME/include and $NAR_HOME/lib.
 cd "$(dirname "$0")"
-CGO_ENABLED=1 go build -o ~/.nar/bin/nar ./cmd/nar/nar.go
+if [ -n "$NAR_HOME" ] || ! pkg-config --exists nar-runtime-c 2>/dev/null; then
+  NAR_HOME="${NAR_HOME:-$HOME/.nar}"
+  PC_DIR="$(mktemp -d)"
+  trap 'rm -rf "$PC_DIR"' EXIT
+  cat > "$PC_DIR/nar-runtime-c.pc" <<PC
+Name: nar-runtime-c
+Description: Nar runtime
+Version: 1
+Cflags: -I$NAR_HOME/include
+Libs: -L$NAR_HOME/lib -Wl,-rpath,$NAR_HOME/lib -lnar-runtime-c
+PC
+  export PKG_CONFIG_PATH="$PC_DIR${PKG_CONFIG_PATH:+:$PKG_CONFIG_PATH}"
+fi
+NAR_HOME="${NAR_HOME:-$HOME/.nar}"
+CGO_ENABLED=1 go build -o "$NAR_HOME/bin/nar" ./cmd/nar
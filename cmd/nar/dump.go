@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/nar-lang/nar-compiler/bytecode"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const binarSignature = 'N'<<8 | 'A'<<16 | 'R'<<24
+
+type dumpBinary struct {
+	FormatVersion   uint32            `json:"formatVersion"`
+	CompilerVersion uint32            `json:"compilerVersion"`
+	Debug           bool              `json:"debug"`
+	Entry           string            `json:"entry"`
+	Strings         []string          `json:"strings"`
+	Consts          []dumpConst       `json:"consts"`
+	Funcs           []dumpFunc        `json:"funcs"`
+	Exports         map[string]uint32 `json:"exports"`
+	Packages        map[string]uint32 `json:"packages"`
+	Errors          []dumpError       `json:"errors,omitempty"`
+}
+
+type dumpConst struct {
+	Kind  string `json:"kind"`
+	Value any    `json:"value"`
+}
+
+type dumpFunc struct {
+	Name     string   `json:"name"`
+	NumArgs  uint32   `json:"numArgs"`
+	FilePath string   `json:"filePath,omitempty"`
+	Ops      []dumpOp `json:"ops"`
+	offset   int64
+}
+
+type dumpOp struct {
+	Kind     string `json:"kind"`
+	Args     string `json:"args,omitempty"`
+	Raw      uint64 `json:"raw"`
+	Line     uint32 `json:"line,omitempty"`
+	Column   uint32 `json:"column,omitempty"`
+	offset   int64
+	hasDebug bool
+}
+
+type dumpError struct {
+	Offset  int64  `json:"offset"`
+	Message string `json:"message"`
+}
+
+func (e dumpError) Error() string {
+	return fmt.Sprintf("offset 0x%08x: %s", e.Offset, e.Message)
+}
+
+func doDump(args []string) error {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	asJson := flags.Bool("json", false, "print dump in json format")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: nar dump [-json] file.binar")
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	bin, err := readDump(f, stat.Size())
+	if bin != nil {
+		if *asJson {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if jsonErr := enc.Encode(bin); jsonErr != nil {
+				return jsonErr
+			}
+		} else {
+			printDump(os.Stdout, bin)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if len(bin.Errors) > 0 {
+		return fmt.Errorf("%s has %d structural error(s)", flags.Arg(0), len(bin.Errors))
+	}
+	return nil
+}
+
+type dumpReader struct {
+	r      io.Reader
+	offset int64
+	size   int64
+}
+
+func (d *dumpReader) read(v any) {
+	if err := binary.Read(d.r, binary.LittleEndian, v); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			panic(dumpError{Offset: d.offset, Message: "unexpected end of file"})
+		}
+		panic(dumpError{Offset: d.offset, Message: err.Error()})
+	}
+	d.offset += int64(binary.Size(v))
+}
+
+func (d *dumpReader) u32() (v uint32) {
+	d.read(&v)
+	return
+}
+
+func (d *dumpReader) str() string {
+	lengthOffset := d.offset
+	l := d.u32()
+	if int64(l) > d.size-d.offset {
+		panic(dumpError{Offset: lengthOffset, Message: fmt.Sprintf(
+			"string length %d exceeds remaining %d bytes of file", l, d.size-d.offset)})
+	}
+	bs := make([]byte, l)
+	d.read(bs)
+	return string(bs)
+}
+
+// readDump reads binar file of the given size keeping track of offsets. Truncated or malformed file returns
+// already read part with an error, semantic inconsistencies are collected to Errors field
+func readDump(reader io.Reader, size int64) (bin *dumpBinary, err error) {
+	d := &dumpReader{r: reader, size: size}
+	bin = &dumpBinary{Exports: map[string]uint32{}, Packages: map[string]uint32{}}
+
+	defer func() {
+		if r := recover(); r != nil {
+			if de, ok := r.(dumpError); ok {
+				bin.decodeOps()
+				err = de
+				return
+			}
+			panic(r)
+		}
+	}()
+
+	if sign := d.u32(); sign != binarSignature {
+		return nil, dumpError{Offset: 0, Message: "invalid file signature, not a binar file"}
+	}
+	versionOffset := d.offset
+	bin.FormatVersion = d.u32()
+	if bin.FormatVersion != bytecode.Version {
+		bin.Errors = append(bin.Errors, dumpError{Offset: versionOffset, Message: fmt.Sprintf(
+			"unsupported format version %s (expected %s)",
+			versionString(bin.FormatVersion), versionString(bytecode.Version))})
+	}
+	bin.CompilerVersion = d.u32()
+	d.read(&bin.Debug)
+	entryOffset := d.offset
+	bin.Entry = d.str()
+
+	numStrings := d.u32()
+	for i := uint32(0); i < numStrings; i++ {
+		bin.Strings = append(bin.Strings, d.str())
+	}
+
+	numConsts := d.u32()
+	for i := uint32(0); i < numConsts; i++ {
+		constOffset := d.offset
+		var kind uint8
+		var packed uint64
+		d.read(&kind)
+		d.read(&packed)
+		switch bytecode.ConstHashKind(kind) {
+		case bytecode.ConstHashKindInt:
+			bin.Consts = append(bin.Consts, dumpConst{Kind: "int", Value: int64(packed)})
+		case bytecode.ConstHashKindFloat:
+			bin.Consts = append(bin.Consts, dumpConst{Kind: "float", Value: math.Float64frombits(packed)})
+		default:
+			bin.Consts = append(bin.Consts, dumpConst{Kind: "unknown", Value: packed})
+			bin.Errors = append(bin.Errors, dumpError{Offset: constOffset,
+				Message: fmt.Sprintf("const #%d has unknown kind %d", i, kind)})
+		}
+	}
+
+	numFuncs := d.u32()
+	for i := uint32(0); i < numFuncs; i++ {
+		fn := dumpFunc{offset: d.offset}
+		nameIndex := d.u32()
+		fn.Name = bin.stringAt(nameIndex)
+		if int(nameIndex) >= len(bin.Strings) {
+			bin.Errors = append(bin.Errors, dumpError{Offset: fn.offset,
+				Message: fmt.Sprintf("func #%d name refers to missing string #%d", i, nameIndex)})
+		}
+		fn.NumArgs = d.u32()
+		numOps := d.u32()
+		for j := uint32(0); j < numOps; j++ {
+			op := dumpOp{offset: d.offset}
+			d.read(&op.Raw)
+			fn.Ops = append(fn.Ops, op)
+		}
+		if bin.Debug {
+			fn.FilePath = d.str()
+			for j := range fn.Ops {
+				fn.Ops[j].Line = d.u32()
+				fn.Ops[j].Column = d.u32()
+				fn.Ops[j].hasDebug = true
+			}
+		}
+		bin.Funcs = append(bin.Funcs, fn)
+	}
+
+	numExports := d.u32()
+	for i := uint32(0); i < numExports; i++ {
+		exportOffset := d.offset
+		name := d.str()
+		ptr := d.u32()
+		if ptr >= numFuncs {
+			bin.Errors = append(bin.Errors, dumpError{Offset: exportOffset,
+				Message: fmt.Sprintf("export %s refers to missing func #%d", name, ptr)})
+		}
+		bin.Exports[name] = ptr
+	}
+
+	numPackages := d.u32()
+	for i := uint32(0); i < numPackages; i++ {
+		name := d.str()
+		bin.Packages[name] = d.u32()
+	}
+
+	if n, _ := reader.Read(make([]byte, 1)); n > 0 {
+		bin.Errors = append(bin.Errors, dumpError{Offset: d.offset, Message: "unexpected data after the end of file"})
+	}
+
+	if _, ok := bin.Exports[bin.Entry]; bin.Entry != "" && !ok {
+		bin.Errors = append(bin.Errors, dumpError{Offset: entryOffset,
+			Message: fmt.Sprintf("entry point %s is not exported", bin.Entry)})
+	}
+
+	bin.decodeOps()
+	return bin, nil
+}
+
+func (b *dumpBinary) decodeOps() {
+	for i := range b.Funcs {
+		fn := &b.Funcs[i]
+		for j := range fn.Ops {
+			if msg := b.decodeOp(&fn.Ops[j], j, len(fn.Ops)); msg != "" {
+				b.Errors = append(b.Errors, dumpError{Offset: fn.Ops[j].offset,
+					Message: fmt.Sprintf("func #%d %s, op %d: %s", i, fn.Name, j, msg)})
+			}
+		}
+	}
+}
+
+func (b *dumpBinary) stringAt(index uint32) string {
+	if int(index) < len(b.Strings) {
+		return b.Strings[index]
+	}
+	return fmt.Sprintf("<missing string #%d>", index)
+}
+
+// decodeOp fills human-readable representation of the op and returns description of found error
+func (b *dumpBinary) decodeOp(op *dumpOp, index int, numOps int) string {
+	kind, x, y, a := bytecode.Op(op.Raw).Decompose()
+
+	str := func() string {
+		if int(a) >= len(b.Strings) {
+			return ""
+		}
+		return strconv.Quote(b.Strings[a])
+	}
+	missingString := fmt.Sprintf("refers to missing string #%d", a)
+
+	switch kind {
+	case bytecode.OpKindLoadLocal:
+		op.Kind = "load-local"
+		op.Args = str()
+		if op.Args == "" {
+			return missingString
+		}
+	case bytecode.OpKindLoadGlobal:
+		op.Kind = "load-global"
+		if int(a) >= len(b.Funcs) {
+			op.Args = fmt.Sprintf("#%d", a)
+			return fmt.Sprintf("refers to missing func #%d", a)
+		}
+		op.Args = fmt.Sprintf("#%d %s", a, b.Funcs[a].Name)
+	case bytecode.OpKindLoadConst:
+		op.Kind = "load-const"
+		stack := "object"
+		if bytecode.StackKind(x) == bytecode.StackKindPattern {
+			stack = "pattern"
+		}
+		switch bytecode.ConstKind(y) {
+		case bytecode.ConstKindUnit:
+			op.Args = stack + " unit"
+		case bytecode.ConstKindChar:
+			op.Args = fmt.Sprintf("%s char %s", stack, strconv.QuoteRune(rune(a)))
+		case bytecode.ConstKindInt, bytecode.ConstKindFloat:
+			if int(a) >= len(b.Consts) {
+				op.Args = fmt.Sprintf("%s #%d", stack, a)
+				return fmt.Sprintf("refers to missing const #%d", a)
+			}
+			op.Args = fmt.Sprintf("%s %s %v", stack, b.Consts[a].Kind, b.Consts[a].Value)
+		case bytecode.ConstKindString:
+			op.Args = fmt.Sprintf("%s string %s", stack, str())
+			if str() == "" {
+				return missingString
+			}
+		default:
+			return fmt.Sprintf("unknown const kind %d", y)
+		}
+	case bytecode.OpKindApply:
+		op.Kind = "apply"
+		op.Args = fmt.Sprintf("args=%d", x)
+	case bytecode.OpKindCall:
+		op.Kind = "call"
+		op.Args = fmt.Sprintf("%s args=%d", str(), x)
+		if str() == "" {
+			return missingString
+		}
+	case bytecode.OpKindJump:
+		op.Kind = "jump"
+		if x != 0 {
+			op.Kind = "jump-if-not-match"
+		}
+		target := index + 1 + int(int32(a))
+		op.Args = fmt.Sprintf("%+d -> %04d", int32(a), target)
+		if target < 0 || target > numOps {
+			return fmt.Sprintf("jumps outside of function to op %d", target)
+		}
+	case bytecode.OpKindMakeObject:
+		op.Kind = "make-object"
+		kinds := map[bytecode.ObjectKind]string{
+			bytecode.ObjectKindList:   "list",
+			bytecode.ObjectKindTuple:  "tuple",
+			bytecode.ObjectKindRecord: "record",
+			bytecode.ObjectKindOption: "option",
+		}
+		k, ok := kinds[bytecode.ObjectKind(x)]
+		op.Args = fmt.Sprintf("%s size=%d", k, a)
+		if !ok {
+			return fmt.Sprintf("unknown object kind %d", x)
+		}
+	case bytecode.OpKindMakePattern:
+		op.Kind = "make-pattern"
+		switch bytecode.PatternKind(x) {
+		case bytecode.PatternKindAlias, bytecode.PatternKindNamed, bytecode.PatternKindDataOption:
+			names := map[bytecode.PatternKind]string{
+				bytecode.PatternKindAlias:      "alias",
+				bytecode.PatternKindNamed:      "named",
+				bytecode.PatternKindDataOption: "option",
+			}
+			op.Args = fmt.Sprintf("%s %s nested=%d", names[bytecode.PatternKind(x)], str(), y)
+			if str() == "" {
+				return missingString
+			}
+		case bytecode.PatternKindList, bytecode.PatternKindRecord:
+			name := "list"
+			if bytecode.PatternKind(x) == bytecode.PatternKindRecord {
+				name = "record"
+			}
+			op.Args = fmt.Sprintf("%s nested=%d", name, a)
+		case bytecode.PatternKindAny, bytecode.PatternKindCons, bytecode.PatternKindConst, bytecode.PatternKindTuple:
+			names := map[bytecode.PatternKind]string{
+				bytecode.PatternKindAny:   "any",
+				bytecode.PatternKindCons:  "cons",
+				bytecode.PatternKindConst: "const",
+				bytecode.PatternKindTuple: "tuple",
+			}
+			op.Args = fmt.Sprintf("%s nested=%d", names[bytecode.PatternKind(x)], y)
+		default:
+			return fmt.Sprintf("unknown pattern kind %d", x)
+		}
+	case bytecode.OpKindAccess:
+		op.Kind = "access"
+		op.Args = str()
+		if op.Args == "" {
+			return missingString
+		}
+	case bytecode.OpKindUpdate:
+		op.Kind = "update"
+		op.Args = str()
+		if op.Args == "" {
+			return missingString
+		}
+	case bytecode.OpKindSwapPop:
+		op.Kind = "swap-pop"
+		switch bytecode.SwapPopMode(x) {
+		case bytecode.SwapPopModeBoth:
+			op.Args = "both"
+		case bytecode.SwapPopModePop:
+			op.Args = "pop"
+		default:
+			return fmt.Sprintf("unknown swap-pop mode %d", x)
+		}
+	default:
+		op.Kind = "unknown"
+		return fmt.Sprintf("unknown op kind %d", kind)
+	}
+	return ""
+}
+
+func printDump(w io.Writer, bin *dumpBinary) {
+	p := func(format string, args ...any) {
+		_, _ = fmt.Fprintf(w, format+"\n", args...)
+	}
+
+	p("format version: %s", versionString(bin.FormatVersion))
+	p("compiler version: %s", versionString(bin.CompilerVersion))
+	p("debug symbols: %v", bin.Debug)
+	p("entry point: %s", bin.Entry)
+
+	p("\npackages (%d):", len(bin.Packages))
+	packageNames := make([]string, 0, len(bin.Packages))
+	for name := range bin.Packages {
+		packageNames = append(packageNames, name)
+	}
+	slices.Sort(packageNames)
+	for _, name := range packageNames {
+		p("  %s %d", name, bin.Packages[name])
+	}
+
+	p("\nstrings (%d):", len(bin.Strings))
+	for i, s := range bin.Strings {
+		p("  #%d %s", i, strconv.Quote(s))
+	}
+
+	p("\nconsts (%d):", len(bin.Consts))
+	for i, c := range bin.Consts {
+		p("  #%d %s %v", i, c.Kind, c.Value)
+	}
+
+	p("\nexports (%d):", len(bin.Exports))
+	exportNames := make([]string, 0, len(bin.Exports))
+	for name := range bin.Exports {
+		exportNames = append(exportNames, name)
+	}
+	slices.Sort(exportNames)
+	for _, name := range exportNames {
+		p("  %s -> func #%d", name, bin.Exports[name])
+	}
+
+	p("\nfuncs (%d):", len(bin.Funcs))
+	for i, fn := range bin.Funcs {
+		header := fmt.Sprintf("  func #%d %s (args: %d)", i, fn.Name, fn.NumArgs)
+		if fn.FilePath != "" {
+			header += " " + fn.FilePath
+		}
+		p(header)
+		for j, op := range fn.Ops {
+			line := fmt.Sprintf("    %04d  %-18s %s", j, op.Kind, op.Args)
+			if op.hasDebug {
+				line = fmt.Sprintf("%-64s ; %d:%d", line, op.Line, op.Column)
+			}
+			p(strings.TrimRight(line, " "))
+		}
+	}
+
+	if len(bin.Errors) > 0 {
+		p("\nerrors (%d):", len(bin.Errors))
+		for _, e := range bin.Errors {
+			p("  %s", e.Error())
+		}
+	}
+}
+
+// describeBinarErrors validates binary data and returns found structural errors ready to be appended to a message
+func describeBinarErrors(data []byte) string {
+	bin, err := readDump(bytes.NewReader(data), int64(len(data)))
+	var errs []string
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	if bin != nil {
+		for _, e := range bin.Errors {
+			errs = append(errs, e.Error())
+		}
+	}
+	if len(errs) == 0 {
+		return ""
+	}
+	return "\n" + strings.Join(errs, "\n")
+}
+
+func versionString(v uint32) string {
+	return fmt.Sprintf("%d.%02d", v/100, v%100)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/nar-lang/nar-compiler/bytecode"
+	"strings"
+	"testing"
+)
+
+// binarBuilder writes binar file fields in the order they are read by readDump
+type binarBuilder struct {
+	bytes.Buffer
+}
+
+func (b *binarBuilder) u8(v uint8) *binarBuilder {
+	b.WriteByte(v)
+	return b
+}
+
+func (b *binarBuilder) u32(v uint32) *binarBuilder {
+	_ = binary.Write(b, binary.LittleEndian, v)
+	return b
+}
+
+func (b *binarBuilder) u64(v uint64) *binarBuilder {
+	_ = binary.Write(b, binary.LittleEndian, v)
+	return b
+}
+
+func (b *binarBuilder) str(s string) *binarBuilder {
+	b.u32(uint32(len(s)))
+	b.WriteString(s)
+	return b
+}
+
+// header writes signature, versions, debug flag and entry point
+func (b *binarBuilder) header(version uint32, entry string) *binarBuilder {
+	return b.u32(binarSignature).u32(version).u32(0).u8(0).str(entry)
+}
+
+// validBinar has a string, a const, a function without ops exported as the entry point and a package
+func validBinar() *binarBuilder {
+	b := &binarBuilder{}
+	b.header(bytecode.Version, "Main.main")
+	b.u32(1).str("Main.main")
+	b.u32(1).u8(uint8(bytecode.ConstHashKindInt)).u64(42)
+	b.u32(1).u32(0).u32(0).u32(0)
+	b.u32(1).str("Main.main").u32(0)
+	b.u32(1).str("Main").u32(1)
+	return b
+}
+
+func TestReadDump(t *testing.T) {
+	tests := []struct {
+		name string
+		data func() []byte
+		// err is a part of the returned error message, empty if the file should be read completely
+		err string
+		// errors are parts of messages of collected structural errors
+		errors []string
+	}{
+		{
+			name: "valid",
+			data: func() []byte { return validBinar().Bytes() },
+		},
+		{
+			name: "invalid signature",
+			data: func() []byte { return (&binarBuilder{}).u32(0).Bytes() },
+			err:  "not a binar file",
+		},
+		{
+			name: "truncated",
+			data: func() []byte {
+				data := validBinar().Bytes()
+				return data[:len(data)-2]
+			},
+			err: "unexpected end of file",
+		},
+		{
+			name: "string length exceeds file",
+			data: func() []byte {
+				b := &binarBuilder{}
+				b.u32(binarSignature).u32(bytecode.Version).u32(0).u8(0).u32(0xffffffff)
+				return b.Bytes()
+			},
+			err: "string length 4294967295 exceeds remaining 0 bytes",
+		},
+		{
+			name: "string length exceeds file by one byte",
+			data: func() []byte {
+				b := &binarBuilder{}
+				b.u32(binarSignature).u32(bytecode.Version).u32(0).u8(0).u32(3)
+				b.WriteString("ab")
+				return b.Bytes()
+			},
+			err: "string length 3 exceeds remaining 2 bytes",
+		},
+		{
+			name: "unsupported version",
+			data: func() []byte {
+				b := validBinar()
+				binary.LittleEndian.PutUint32(b.Bytes()[4:], bytecode.Version+1)
+				return b.Bytes()
+			},
+			errors: []string{"unsupported format version"},
+		},
+		{
+			name: "unknown const kind",
+			data: func() []byte {
+				b := &binarBuilder{}
+				b.header(bytecode.Version, "")
+				b.u32(0)
+				b.u32(1).u8(0xff).u64(0)
+				b.u32(0).u32(0).u32(0)
+				return b.Bytes()
+			},
+			errors: []string{"const #0 has unknown kind 255"},
+		},
+		{
+			name: "missing func name and export target",
+			data: func() []byte {
+				b := &binarBuilder{}
+				b.header(bytecode.Version, "")
+				b.u32(0).u32(0)
+				b.u32(1).u32(7).u32(0).u32(0)
+				b.u32(1).str("Main.main").u32(3)
+				b.u32(0)
+				return b.Bytes()
+			},
+			errors: []string{"func #0 name refers to missing string #7", "export Main.main refers to missing func #3"},
+		},
+		{
+			name: "entry point is not exported",
+			data: func() []byte {
+				b := &binarBuilder{}
+				b.header(bytecode.Version, "Main.main")
+				b.u32(0).u32(0).u32(0).u32(0).u32(0)
+				return b.Bytes()
+			},
+			errors: []string{"entry point Main.main is not exported"},
+		},
+		{
+			name:   "data after the end",
+			data:   func() []byte { return validBinar().u8(0).Bytes() },
+			errors: []string{"unexpected data after the end of file"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := tt.data()
+			bin, err := readDump(bytes.NewReader(data), int64(len(data)))
+			if tt.err == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("error is %v, expected %q", err, tt.err)
+			}
+			if bin == nil {
+				if len(tt.errors) > 0 {
+					t.Fatalf("nothing is read, expected errors %v", tt.errors)
+				}
+				return
+			}
+			if len(bin.Errors) != len(tt.errors) {
+				t.Fatalf("structural errors are %v, expected %v", bin.Errors, tt.errors)
+			}
+			for i, e := range bin.Errors {
+				if !strings.Contains(e.Message, tt.errors[i]) {
+					t.Errorf("structural error is %q, expected %q", e.Message, tt.errors[i])
+				}
+			}
+		})
+	}
+}
@@ -5,11 +5,12 @@ import (
 	"strings"
 )
 
-//TODO: how to specify home directory ?
+// Runtime headers and library are located with pkg-config as nar-runtime-c package
+// (see build.sh, it provides the package from NAR_HOME directory if it is not installed).
 
 /*
-#cgo CFLAGS: -I/Users/dvoyni/.nar/include
-#cgo LDFLAGS: -ldl -L/Users/dvoyni/.nar/include -lnar-runtime-c
+#cgo pkg-config: nar-runtime-c
+#cgo LDFLAGS: -ldl
 #include <string.h>
 #include <nar.h>
 #include <nar-runtime.h>
@@ -20,11 +21,16 @@ import (
 	"bytes"
 	"flag"
 	"fmt"
+	"github.com/nar-lang/nar-compiler/ast"
+	"github.com/nar-lang/nar-compiler/ast/normalized"
+	"github.com/nar-lang/nar-compiler/ast/parsed"
+	"github.com/nar-lang/nar-compiler/ast/typed"
 	"github.com/nar-lang/nar-compiler/bytecode"
 	"github.com/nar-lang/nar-compiler/compiler"
 	"github.com/nar-lang/nar-compiler/linker"
 	"github.com/nar-lang/nar-compiler/locator"
 	"github.com/nar-lang/nar-compiler/logger"
+	"github.com/nar/internal/build"
 	"github.com/nar/pkg"
 	"path/filepath"
 	"unsafe"
@@ -40,11 +46,56 @@ func main() {
 	showVersion := flag.Bool("version", false, "show version")
 	run := flag.Bool("run", false, "execute program after compilation")
 	binar := flag.String("binar", "", "execute program from binar file")
+	libs := flag.String("libs", "", "native libraries directory (default: directory of executed program)")
+	sandboxed := flag.Bool("sandbox", false, "run program in a sandbox (native libraries and resources are restricted)")
+	allowNative := flag.String("allow-native", "", "comma separated native libraries allowed in a sandbox")
+	timeout := flag.Duration("timeout", 0, "wall-clock time limit of sandboxed program (e.g. 10s)")
+	maxMemory := flag.Int("max-memory", 0, "memory limit of sandboxed program in megabytes")
+	maxCpu := flag.Duration("max-cpu", 0, "cpu time limit of sandboxed program, used instead of instruction limit (e.g. 5s)")
+	sandboxChild := flag.Bool("sandbox-child", false, "internal: execute -binar as a sandboxed child process")
+	trace := flag.String("trace", "", "write compilation timings to the file in chrome trace event format")
 	lspEnable := flag.Bool("lsp", false, "start language server")
 	flag.Bool("stdio", false, "use stdio for language server (default)")
 	lspTcp := flag.Int("tcp", 0, "use tcp transport with given port for language server")
 	flag.Parse()
 
+	if *sandboxChild {
+		if err := doRunSandboxChild(*binar, *libs, *maxMemory, *maxCpu); err != nil {
+			fmt.Println(err)
+			os.Exit(-1)
+		}
+		return
+	}
+
+	sb, err := newSandbox(*sandboxed, *allowNative, *timeout, *maxMemory, *maxCpu)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+
+	if args := flag.Args(); len(args) > 0 && args[0] == "dump" {
+		if err := doDump(args[1:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if args := flag.Args(); len(args) > 0 && (args[0] == "run" || isScriptFile(args[0])) {
+		if args[0] == "run" {
+			args = args[1:]
+		}
+		if len(args) == 0 {
+			fmt.Println("script file is not specified")
+			os.Exit(-1)
+		}
+		if err := doRunScript(*cache, *libs, sb, args[0], args[1:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if *showVersion {
 		doShowVersion()
 		return
@@ -56,7 +107,7 @@ func main() {
 	}
 
 	if *binar != "" {
-		if err := doRunBinar(*binar); err != nil {
+		if err := doRunBinar(*binar, *libs, sb); err != nil {
 			fmt.Println(err)
 			os.Exit(-1)
 		}
@@ -69,7 +120,19 @@ func main() {
 		lnk = linker.NewDllLinker(*out)
 	}
 
-	bin := doCompile(*release, *cache, lnk, flag.Args())
+	var tracer *build.Tracer
+	if *trace != "" {
+		tracer = build.NewTracer()
+	}
+
+	bin := doCompile(*release, *cache, lnk, flag.Args(), tracer)
+
+	if tracer != nil {
+		if err := writeTrace(tracer, *trace); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
 
 	if bin != nil && *run {
 		buf := bytes.NewBuffer(nil)
@@ -85,7 +148,7 @@ func main() {
 			os.Exit(1)
 		}
 
-		err = doRun(buf.Bytes(), filepath.Dir(*out))
+		err = runProgram(sb, buf.Bytes(), libsDir(*libs, filepath.Dir(*out)))
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
@@ -93,17 +156,43 @@ func main() {
 	}
 }
 
-func doRunBinar(path string) error {
+func doRunBinar(path string, libs string, sb *sandbox) error {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return err
 	}
-	return doRun(data, filepath.Dir(path))
+	return runProgram(sb, data, libsDir(libs, filepath.Dir(path)))
+}
+
+func libsDir(libs string, programDir string) string {
+	if libs != "" {
+		return libs
+	}
+	return programDir
 }
 
-func doCompile(release bool, cacheDir string, link linker.Linker, packages []string) *bytecode.Binary {
+func doCompile(
+	release bool, cacheDir string, link linker.Linker, packages []string, tracer *build.Tracer,
+) *bytecode.Binary {
 	log := &logger.LogWriter{FailOnErr: true}
+	providers := packageProviders(log, cacheDir, packages)
+	return compileProviders(log, release, link, providers, tracer)
+}
 
+func writeTrace(tracer *build.Tracer, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := tracer.WriteChromeTrace(f); err != nil {
+		return err
+	}
+	tracer.WriteSummary(os.Stdout, 10)
+	return nil
+}
+
+func packageProviders(log *logger.LogWriter, cacheDir string, packages []string) []locator.Provider {
 	var providers []locator.Provider
 	for _, path := range packages {
 		if s, err := os.Stat(path); err != nil || !s.IsDir() {
@@ -122,15 +211,32 @@ func doCompile(release bool, cacheDir string, link linker.Linker, packages []str
 		}
 		providers = append(providers, locator.NewDirectoryProvider(cacheDir))
 	}
+	return providers
+}
 
+func compileProviders(
+	log *logger.LogWriter, release bool, link linker.Linker, providers []locator.Provider, tracer *build.Tracer,
+) *bytecode.Binary {
 	var bin *bytecode.Binary
 	if !log.Err() {
 		//TODO: add git repository provider
 		var lc = locator.NewLocator(providers...)
-		bin = compiler.Compile(log, lc, link, !release)
+		bin, _ = build.CompileEx(log, lc, link, !release,
+			map[ast.QualifiedIdentifier]*parsed.Module{},
+			map[ast.QualifiedIdentifier]*normalized.Module{},
+			map[ast.QualifiedIdentifier]*typed.Module{},
+			tracer)
+	}
+	failed := len(log.Errors()) > 0
+	out := log.OutStream
+	if out == nil {
+		out = os.Stdout
 	}
 	log.Trace("compilation finished")
-	log.Flush(os.Stdout)
+	log.Flush(out)
+	if failed {
+		return nil
+	}
 	return bin
 }
 
@@ -180,7 +286,7 @@ func doRun(data []byte, libsPath string) (err error) {
 
 	btcErr := C.nar_get_error(nil)
 	if btc == nil || btcErr != nil {
-		err = fmt.Errorf("could not create bytecode (error code %s)", toStr(btcErr))
+		err = fmt.Errorf("could not create bytecode (error code %s)%s", toStr(btcErr), describeBinarErrors(data))
 		goto cleanup
 	}
 
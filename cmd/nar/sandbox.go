@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sandbox runs program in a child process that can register only allowed native libraries
+// and has limited wall-clock time, memory and cpu time.
+// The runtime has no instruction counter, cpu time limit is used instead of instruction limit.
+type sandbox struct {
+	allowedNative map[string]struct{}
+	timeout       time.Duration
+	maxMemoryMb   int
+	maxCpu        time.Duration
+}
+
+// newSandbox returns nil if sandbox is not enabled. Restrictions given without enabling the sandbox
+// are reported as an error instead of being silently ignored.
+func newSandbox(enabled bool, allowNative string, timeout time.Duration, maxMemoryMb int, maxCpu time.Duration) (*sandbox, error) {
+	if !enabled {
+		var restrictions []string
+		if allowNative != "" {
+			restrictions = append(restrictions, "-allow-native")
+		}
+		if timeout != 0 {
+			restrictions = append(restrictions, "-timeout")
+		}
+		if maxMemoryMb != 0 {
+			restrictions = append(restrictions, "-max-memory")
+		}
+		if maxCpu != 0 {
+			restrictions = append(restrictions, "-max-cpu")
+		}
+		if len(restrictions) > 0 {
+			return nil, fmt.Errorf("%s can be used only with -sandbox flag", strings.Join(restrictions, ", "))
+		}
+		return nil, nil
+	}
+	sb := &sandbox{
+		allowedNative: map[string]struct{}{},
+		timeout:       timeout,
+		maxMemoryMb:   maxMemoryMb,
+		maxCpu:        maxCpu,
+	}
+	for _, name := range strings.Split(allowNative, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			sb.allowedNative[name] = struct{}{}
+		}
+	}
+	return sb, nil
+}
+
+func runProgram(sb *sandbox, data []byte, libsPath string) error {
+	if sb == nil {
+		return doRun(data, libsPath)
+	}
+	return sb.run(data, libsPath)
+}
+
+// doRunSandboxChild is executed inside of the child process started by sandbox.run
+func doRunSandboxChild(path string, libsPath string, maxMemoryMb int, maxCpu time.Duration) error {
+	if err := applyLimits(maxMemoryMb, maxCpu); err != nil {
+		return fmt.Errorf("failed to apply sandbox limits: %w", err)
+	}
+	return doRunBinar(path, libsPath, nil)
+}
+
+func (sb *sandbox) run(data []byte, libsPath string) error {
+	tmpDir, err := os.MkdirTemp("", "nar-sandbox-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	sandboxLibs := filepath.Join(tmpDir, "libs")
+	if err := sb.linkAllowedLibs(libsPath, sandboxLibs); err != nil {
+		return err
+	}
+	programPath := filepath.Join(tmpDir, "program.binar")
+	if err := os.WriteFile(programPath, data, 0644); err != nil {
+		return err
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	args := []string{"-sandbox-child", "-binar", programPath, "-libs", sandboxLibs}
+	if sb.maxMemoryMb > 0 {
+		args = append(args, "-max-memory", strconv.Itoa(sb.maxMemoryMb))
+	}
+	if sb.maxCpu > 0 {
+		args = append(args, "-max-cpu", sb.maxCpu.String())
+	}
+
+	ctx := context.Background()
+	if sb.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, sb.timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, exe, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Run()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("program was stopped: wall-clock time limit of %s exceeded", sb.timeout)
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if msg := describeLimitExit(exitErr.ProcessState, sb.maxMemoryMb, sb.maxCpu); msg != "" {
+			return fmt.Errorf("program was stopped: %s", msg)
+		}
+		return fmt.Errorf("program failed with exit code %d", exitErr.ExitCode())
+	}
+	return err
+}
+
+// linkAllowedLibs exposes allowed native libraries from libsPath to the sandbox directory
+func (sb *sandbox) linkAllowedLibs(libsPath string, sandboxLibs string) error {
+	if err := os.Mkdir(sandboxLibs, 0755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(libsPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !sb.isNativeAllowed(entry.Name()) {
+			continue
+		}
+		src, err := filepath.Abs(filepath.Join(libsPath, entry.Name()))
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(src, filepath.Join(sandboxLibs, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sb *sandbox) isNativeAllowed(fileName string) bool {
+	if _, ok := sb.allowedNative[fileName]; ok {
+		return true
+	}
+	name := strings.TrimPrefix(strings.TrimSuffix(fileName, filepath.Ext(fileName)), "lib")
+	_, ok := sb.allowedNative[name]
+	return ok
+}
@@ -0,0 +1,20 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+func applyLimits(maxMemoryMb int, maxCpu time.Duration) error {
+	if maxMemoryMb > 0 || maxCpu > 0 {
+		return errors.New("memory and cpu limits are not supported on this platform")
+	}
+	return nil
+}
+
+func describeLimitExit(state *os.ProcessState, maxMemoryMb int, maxCpu time.Duration) string {
+	return ""
+}
@@ -0,0 +1,56 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func applyLimits(maxMemoryMb int, maxCpu time.Duration) error {
+	if maxMemoryMb > 0 {
+		limit := uint64(maxMemoryMb) << 20
+		if err := syscall.Setrlimit(syscall.RLIMIT_AS, &syscall.Rlimit{Cur: limit, Max: limit}); err != nil {
+			return err
+		}
+	}
+	if maxCpu > 0 {
+		seconds := cpuSeconds(maxCpu)
+		if err := syscall.Setrlimit(syscall.RLIMIT_CPU, &syscall.Rlimit{Cur: seconds, Max: seconds + 1}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// describeLimitExit reports the signal the program was killed with and the limits applied to it,
+// only SIGXCPU unambiguously means that the soft cpu limit was hit
+func describeLimitExit(state *os.ProcessState, maxMemoryMb int, maxCpu time.Duration) string {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return ""
+	}
+	if status.Signal() == syscall.SIGXCPU {
+		return fmt.Sprintf("cpu time limit exceeded (SIGXCPU, RLIMIT_CPU %ds)", cpuSeconds(maxCpu))
+	}
+	var limits []string
+	if maxMemoryMb > 0 {
+		limits = append(limits, fmt.Sprintf("RLIMIT_AS %d MB", maxMemoryMb))
+	}
+	if maxCpu > 0 {
+		limits = append(limits, fmt.Sprintf("RLIMIT_CPU %ds", cpuSeconds(maxCpu)))
+	}
+	if len(limits) == 0 {
+		return fmt.Sprintf("terminated by signal %d (%s)", status.Signal(), status.Signal())
+	}
+	return fmt.Sprintf("terminated by signal %d (%s), applied limits: %s",
+		status.Signal(), status.Signal(), strings.Join(limits, ", "))
+}
+
+// cpuSeconds rounds cpu time limit up to whole seconds as RLIMIT_CPU is set in seconds
+func cpuSeconds(maxCpu time.Duration) uint64 {
+	return uint64((maxCpu + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/nar-lang/nar-compiler"
+	"github.com/nar-lang/nar-compiler/ast"
+	"github.com/nar-lang/nar-compiler/bytecode"
+	"github.com/nar-lang/nar-compiler/common"
+	"github.com/nar-lang/nar-compiler/compiler"
+	"github.com/nar-lang/nar-compiler/linker"
+	"github.com/nar-lang/nar-compiler/locator"
+	"github.com/nar-lang/nar-compiler/logger"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Script files are single .nar modules compiled as an implicit package.
+// Leading comment lines may contain directives that replace nar.json:
+//
+//	#!/usr/bin/env nar
+//	//nar:dependency Nar.Base 100
+//	//nar:main Hello.main
+//	module Hello
+//
+// By default the entry point is `main` definition of the script module.
+
+const (
+	scriptExt               = ".nar"
+	scriptPackageName       = "Script"
+	scriptDirectivePrefix   = "nar:"
+	scriptDependencyKeyword = "dependency"
+	scriptMainKeyword       = "main"
+	scriptProgramFileName   = "program.binar"
+	scriptArgsEnv           = "NAR_ARGS"
+)
+
+type scriptHeader struct {
+	dependencies map[string]int
+	main         string
+}
+
+func isScriptFile(path string) bool {
+	if filepath.Ext(path) != scriptExt {
+		return false
+	}
+	s, err := os.Stat(path)
+	return err == nil && !s.IsDir()
+}
+
+func doRunScript(cacheDir string, libs string, sb *sandbox, path string, args []string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	content := stripShebang([]rune(string(data)))
+
+	header, err := parseScriptHeader(path, content)
+	if err != nil {
+		return err
+	}
+	log := &logger.LogWriter{OutStream: os.Stderr, FailOnErr: true}
+	providers := scriptProviders(log, cacheDir, path, content, header)
+	if log.Err() {
+		log.Flush(os.Stderr)
+		return fmt.Errorf("failed to compile script %s", path)
+	}
+	hash, err := scriptHash(providers)
+	if err != nil {
+		return err
+	}
+
+	homeDir, _ := os.UserHomeDir()
+	outDir := filepath.Join(homeDir, ".nar", "scripts", hash)
+	outPath := filepath.Join(outDir, scriptProgramFileName)
+
+	bin, err := os.ReadFile(outPath)
+	if err != nil {
+		if bin, err = compileScript(log, path, providers, outDir); err != nil {
+			return err
+		}
+	}
+
+	argsJson, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	if err = os.Setenv(scriptArgsEnv, string(argsJson)); err != nil {
+		return err
+	}
+	return runProgram(sb, bin, libsDir(libs, outDir))
+}
+
+// scriptProviders returns providers of the implicit script package and packages from the cache directory
+func scriptProviders(
+	log *logger.LogWriter, cacheDir string, path string, content []rune, header scriptHeader,
+) []locator.Provider {
+	info := locator.PackageInfo{
+		Name:         scriptPackageName,
+		Version:      1,
+		NarVersion:   int(compiler.Version),
+		Dependencies: header.dependencies,
+		Main:         header.main,
+	}
+	providers := []locator.Provider{
+		locator.NewMemoryPackageProvider(info, map[string][]rune{path: content}),
+	}
+	return append(providers, packageProviders(log, cacheDir, nil)...)
+}
+
+// compileScript builds the script into a temporary directory and moves it to outDir,
+// so the concurrent runs of the same script never see partially written cache
+func compileScript(log *logger.LogWriter, path string, providers []locator.Provider, outDir string) ([]byte, error) {
+	if err := os.MkdirAll(filepath.Dir(outDir), 0755); err != nil {
+		return nil, err
+	}
+	tmpDir, err := os.MkdirTemp(filepath.Dir(outDir), filepath.Base(outDir)+".*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tmpPath := filepath.Join(tmpDir, scriptProgramFileName)
+	if bin := compileProviders(log, false, linker.NewDllLinker(tmpPath), providers, nil); bin == nil {
+		return nil, fmt.Errorf("failed to compile script %s", path)
+	}
+
+	data, err := os.ReadFile(tmpPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile script %s: %w", path, err)
+	}
+	if err := os.Rename(tmpDir, outDir); err != nil {
+		if _, statErr := os.Stat(outDir); statErr != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// stripShebang turns shebang line into a comment keeping all source locations in place
+func stripShebang(content []rune) []rune {
+	if len(content) >= 2 && content[0] == '#' && content[1] == '!' {
+		content = append([]rune("//"), content[2:]...)
+	}
+	return content
+}
+
+// scriptHash identifies compiled script by versions of the compiler and sources of all resolved packages,
+// so changing the script or any of its dependencies invalidates the cache
+func scriptHash(providers []locator.Provider) (string, error) {
+	packages, err := locator.NewLocator(providers...).Packages()
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	_ = binary.Write(h, binary.LittleEndian, compiler.Version)
+	_ = binary.Write(h, binary.LittleEndian, bytecode.Version)
+	for _, pkg := range packages {
+		_, _ = fmt.Fprintf(h, "%s@%d\n", pkg.Info().Name, pkg.Info().Version)
+		sources := pkg.Sources()
+		paths := common.Keys(sources)
+		slices.Sort(paths)
+		for _, p := range paths {
+			_, _ = fmt.Fprintf(h, "%s:%d\n", p, len(sources[p]))
+			h.Write([]byte(string(sources[p])))
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func parseScriptHeader(path string, content []rune) (scriptHeader, error) {
+	header := scriptHeader{dependencies: map[string]int{}}
+
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "//") {
+			break
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "//"))
+		if !strings.HasPrefix(line, scriptDirectivePrefix) {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, scriptDirectivePrefix))
+		if len(fields) == 0 {
+			return header, fmt.Errorf("%s:%d: empty script directive", path, i+1)
+		}
+		switch fields[0] {
+		case scriptDependencyKeyword:
+			if len(fields) < 2 || len(fields) > 3 {
+				return header, fmt.Errorf("%s:%d: expected `dependency <package> [version]`", path, i+1)
+			}
+			version := 0
+			if len(fields) == 3 {
+				var err error
+				if version, err = strconv.Atoi(fields[2]); err != nil {
+					return header, fmt.Errorf("%s:%d: invalid version of package %s", path, i+1, fields[1])
+				}
+			}
+			header.dependencies[fields[1]] = version
+		case scriptMainKeyword:
+			if len(fields) != 2 {
+				return header, fmt.Errorf("%s:%d: expected `main <Module.definition>`", path, i+1)
+			}
+			header.main = fields[1]
+		default:
+			return header, fmt.Errorf("%s:%d: unknown script directive `%s`", path, i+1, fields[0])
+		}
+	}
+
+	if header.main == "" {
+		m, errs := nar_compiler.Parse(path, content)
+		if len(errs) > 0 {
+			return header, errs[0]
+		}
+		header.main = string(common.MakeFullIdentifier(m.Name(), ast.Identifier(scriptMainKeyword)))
+	}
+	return header, nil
+}
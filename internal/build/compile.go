@@ -0,0 +1,197 @@
+package build
+
+import (
+	"fmt"
+	"github.com/nar-lang/nar-compiler"
+	"github.com/nar-lang/nar-compiler/ast"
+	"github.com/nar-lang/nar-compiler/ast/normalized"
+	"github.com/nar-lang/nar-compiler/ast/parsed"
+	"github.com/nar-lang/nar-compiler/ast/typed"
+	"github.com/nar-lang/nar-compiler/bytecode"
+	"github.com/nar-lang/nar-compiler/common"
+	"github.com/nar-lang/nar-compiler/compiler"
+	"github.com/nar-lang/nar-compiler/linker"
+	"github.com/nar-lang/nar-compiler/locator"
+	"github.com/nar-lang/nar-compiler/logger"
+	"slices"
+)
+
+// stepsPerModule is the number of steps recorded for every module: parse, generate, normalize,
+// annotate with types, check patterns and compose
+const stepsPerModule = 6
+
+// CompileEx produces the same result as compiler.CompileEx going through the same exported steps
+// of the compiler, but reports duration of each step of each module to the tracer.
+// Steps that reuse modules from given maps are reported as cache hits. Tracer can be nil.
+func CompileEx(
+	log *logger.LogWriter, lc locator.Locator, link linker.Linker, debug bool,
+	parsedModules map[ast.QualifiedIdentifier]*parsed.Module,
+	normalizedModules map[ast.QualifiedIdentifier]*normalized.Module,
+	typedModules map[ast.QualifiedIdentifier]*typed.Module,
+	tracer *Tracer,
+) (*bytecode.Binary, []ast.QualifiedIdentifier) {
+	bin := bytecode.NewBinary()
+	bin.CompilerVersion = compiler.Version
+	hash := bytecode.NewBinaryHash()
+
+	tracer.Expect(1)
+	end := tracer.Begin(PhaseResolve, "")
+	packages, err := lc.Packages()
+	end()
+	if err != nil {
+		log.Err(err)
+		return bin, nil
+	}
+
+	for _, pkg := range packages {
+		bin.Packages[bytecode.QualifiedIdentifier(pkg.Info().Name)] = uint32(pkg.Info().Version)
+	}
+	if link != nil {
+		tracer.Expect(1)
+	}
+
+	affectedModuleNames := compile(log, packages, parsedModules, normalizedModules, typedModules, tracer)
+
+	if len(log.Errors()) == 0 {
+		for _, name := range affectedModuleNames {
+			m, ok := typedModules[name]
+			if !ok {
+				log.Err(common.NewSystemError(fmt.Errorf("module '%s' not found", name)))
+				continue
+			}
+			end := tracer.Begin(PhaseCompile, name)
+			err := m.Compose(typedModules, debug, bin, hash)
+			end()
+			if err != nil {
+				log.Err(err)
+			}
+		}
+	}
+
+	if !log.Err() {
+		if link != nil {
+			end := tracer.Begin(PhaseLink, "")
+			err := link.Link(log, bin, lc, debug)
+			end()
+			if err != nil {
+				log.Err(err)
+			}
+		}
+	}
+	return bin, affectedModuleNames
+}
+
+// compile follows nar_compiler.Compile step by step, the function itself does not expose its steps
+func compile(
+	log *logger.LogWriter,
+	packages []locator.Package,
+	parsedModules map[ast.QualifiedIdentifier]*parsed.Module,
+	normalizedModules map[ast.QualifiedIdentifier]*normalized.Module,
+	typedModules map[ast.QualifiedIdentifier]*typed.Module,
+	tracer *Tracer,
+) (affectedModuleNames []ast.QualifiedIdentifier) {
+	affectedModules := map[ast.QualifiedIdentifier]struct{}{}
+
+	for _, pkg := range packages {
+		tracer.Expect(len(pkg.Sources()) * stepsPerModule)
+	}
+
+	for _, pkg := range packages {
+		sourceMap := pkg.Sources()
+		keys := common.Keys(sourceMap)
+		slices.Sort(keys)
+
+		for _, path := range keys {
+			var parsedModule *parsed.Module
+			for _, m := range parsedModules {
+				if m.Location().FilePath() == path {
+					parsedModule = m
+				}
+			}
+			start := tracer.Now()
+			if parsedModule != nil {
+				tracer.RecordCached(PhaseParse, parsedModule.Name(), start, true)
+			} else {
+				var errors []error
+				parsedModule, errors = nar_compiler.Parse(path, sourceMap[path])
+				for _, e := range errors {
+					log.Err(e)
+				}
+				if parsedModule == nil {
+					tracer.RecordCached(PhaseParse, ast.QualifiedIdentifier(path), start, false)
+					continue
+				}
+				tracer.RecordCached(PhaseParse, parsedModule.Name(), start, false)
+				parsedModule.SetPackageName(ast.PackageIdentifier(pkg.Info().Name))
+
+				referencedPackages := map[ast.PackageIdentifier]struct{}{}
+				for p := range pkg.Info().Dependencies {
+					referencedPackages[ast.PackageIdentifier(p)] = struct{}{}
+				}
+				parsedModule.SetReferencedPackages(referencedPackages)
+
+				if existedModule, ok := parsedModules[parsedModule.Name()]; ok {
+					log.Err(common.NewErrorOf(parsedModule, "module name collision: `%s`", existedModule.Name()))
+				}
+				parsedModules[parsedModule.Name()] = parsedModule
+			}
+			affectedModules[parsedModule.Name()] = struct{}{}
+		}
+	}
+
+	if log.Err() {
+		return nil
+	}
+
+	affectedModuleNames = common.Keys(affectedModules)
+	slices.Sort(affectedModuleNames)
+
+	for _, name := range affectedModuleNames {
+		end := tracer.Begin(PhaseNormalize, name)
+		err := parsedModules[name].Generate(parsedModules)
+		end()
+		log.Err(err...)
+	}
+
+	if log.Err() {
+		return nil
+	}
+
+	for _, name := range affectedModuleNames {
+		_, cached := normalizedModules[name]
+		start := tracer.Now()
+		err := parsedModules[name].Normalize(parsedModules, normalizedModules)
+		tracer.RecordCached(PhaseNormalize, name, start, cached)
+		if len(err) > 0 {
+			if log.Err(err...) {
+				return
+			}
+			continue
+		}
+
+		_, cached = typedModules[name]
+		start = tracer.Now()
+		err = normalizedModules[name].Annotate(normalizedModules, typedModules)
+		if len(err) == 0 {
+			err = typedModules[name].CheckTypes()
+		}
+		tracer.RecordCached(PhaseTypeSolve, name, start, cached)
+		if len(err) > 0 {
+			if log.Err(err...) {
+				return
+			}
+			continue
+		}
+
+		end := tracer.Begin(PhaseTypeSolve, name)
+		err = typedModules[name].CheckPatterns()
+		end()
+		if len(err) > 0 {
+			if log.Err(err...) {
+				return
+			}
+			continue
+		}
+	}
+	return
+}
@@ -0,0 +1,278 @@
+package build
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"github.com/nar-lang/nar-compiler/ast"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Phase string
+
+const (
+	// PhaseResolve is resolving packages and their dependencies with the locator
+	PhaseResolve Phase = "resolve"
+	// PhaseParse is parsing of a module source
+	PhaseParse Phase = "parse"
+	// PhaseNormalize is generating declarations of a parsed module and normalizing it
+	PhaseNormalize Phase = "normalize"
+	// PhaseTypeSolve is annotating a normalized module with types, checking types and patterns
+	PhaseTypeSolve Phase = "type-solve"
+	// PhaseCompile is composing bytecode of a typed module
+	PhaseCompile Phase = "compile"
+	// PhaseLink is linking the program
+	PhaseLink Phase = "link"
+)
+
+var phases = []Phase{PhaseResolve, PhaseParse, PhaseNormalize, PhaseTypeSolve, PhaseCompile, PhaseLink}
+
+// Step is a finished phase of a module (or of the whole compilation if the module is empty)
+// reported to the observer along with progress of the compilation
+type Step struct {
+	Phase    Phase
+	Module   ast.QualifiedIdentifier
+	CacheHit bool
+	// Done is the number of steps finished so far
+	Done int
+	// Total is the number of steps expected so far, it grows as packages are loaded
+	Total int
+}
+
+// Tracer records duration of compilation phases per module and cache usage of incremental compilation.
+// All methods are safe to call on nil tracer, that does nothing.
+type Tracer struct {
+	locker      sync.Mutex
+	start       time.Time
+	events      []traceEvent
+	cacheHits   map[Phase]int
+	cacheMisses map[Phase]int
+	done        int
+	total       int
+	observer    func(step Step)
+}
+
+type traceEvent struct {
+	phase    Phase
+	module   ast.QualifiedIdentifier
+	start    time.Duration
+	duration time.Duration
+	cacheHit bool
+}
+
+func NewTracer() *Tracer {
+	return &Tracer{
+		start:       time.Now(),
+		cacheHits:   map[Phase]int{},
+		cacheMisses: map[Phase]int{},
+	}
+}
+
+// Observe sets function that is called when a step is finished. It is called synchronously from the compiling goroutine.
+func (t *Tracer) Observe(f func(step Step)) {
+	if t == nil {
+		return
+	}
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	t.observer = f
+}
+
+// Expect adds the number of steps to be finished to the total reported to the observer
+func (t *Tracer) Expect(steps int) {
+	if t == nil {
+		return
+	}
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	t.total += steps
+}
+
+func (t *Tracer) Now() time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// Begin starts measuring phase of the module, returned function finishes it
+func (t *Tracer) Begin(phase Phase, module ast.QualifiedIdentifier) func() {
+	if t == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() { t.Record(phase, module, start) }
+}
+
+// Record finishes the step started at the given time
+func (t *Tracer) Record(phase Phase, module ast.QualifiedIdentifier, start time.Time) {
+	t.record(phase, module, start, false, false)
+}
+
+// RecordCached finishes the step that reuses the module from previous compilation if there is one,
+// such steps are counted in cache statistics of the phase
+func (t *Tracer) RecordCached(phase Phase, module ast.QualifiedIdentifier, start time.Time, cacheHit bool) {
+	t.record(phase, module, start, cacheHit, true)
+}
+
+func (t *Tracer) record(phase Phase, module ast.QualifiedIdentifier, start time.Time, cached bool, counted bool) {
+	if t == nil {
+		return
+	}
+	t.locker.Lock()
+	t.events = append(t.events, traceEvent{
+		phase:    phase,
+		module:   module,
+		start:    start.Sub(t.start),
+		duration: time.Since(start),
+		cacheHit: cached,
+	})
+	if counted {
+		if cached {
+			t.cacheHits[phase]++
+		} else {
+			t.cacheMisses[phase]++
+		}
+	}
+	t.done++
+	observer := t.observer
+	step := Step{Phase: phase, Module: module, CacheHit: cached, Done: t.done, Total: max(t.done, t.total)}
+	t.locker.Unlock()
+	if observer != nil {
+		observer(step)
+	}
+}
+
+type chromeTrace struct {
+	TraceEvents     []chromeEvent  `json:"traceEvents"`
+	DisplayTimeUnit string         `json:"displayTimeUnit"`
+	OtherData       map[string]any `json:"otherData,omitempty"`
+}
+
+type chromeEvent struct {
+	Name      string         `json:"name"`
+	Category  string         `json:"cat"`
+	Phase     string         `json:"ph"`
+	Timestamp int64          `json:"ts"`
+	Duration  int64          `json:"dur"`
+	Pid       int            `json:"pid"`
+	Tid       int            `json:"tid"`
+	Args      map[string]any `json:"args,omitempty"`
+}
+
+// WriteChromeTrace writes recorded events in Chrome trace event format
+// (can be opened with chrome://tracing, Perfetto or speedscope), each phase of a module is a separate slice
+func (t *Tracer) WriteChromeTrace(w io.Writer) error {
+	if t == nil {
+		return nil
+	}
+	t.locker.Lock()
+	defer t.locker.Unlock()
+
+	trace := chromeTrace{
+		TraceEvents:     make([]chromeEvent, 0, len(t.events)),
+		DisplayTimeUnit: "ms",
+		OtherData: map[string]any{
+			"cacheHits":   t.cacheHits,
+			"cacheMisses": t.cacheMisses,
+		},
+	}
+	for _, e := range t.events {
+		name := string(e.phase)
+		if e.module != "" {
+			name = string(e.phase) + " " + string(e.module)
+		}
+		if e.cacheHit {
+			name += " (cached)"
+		}
+		trace.TraceEvents = append(trace.TraceEvents, chromeEvent{
+			Name:      name,
+			Category:  string(e.phase),
+			Phase:     "X",
+			Timestamp: e.start.Microseconds(),
+			Duration:  e.duration.Microseconds(),
+			Pid:       1,
+			Tid:       1,
+			Args:      map[string]any{"phase": e.phase, "module": e.module, "cached": e.cacheHit},
+		})
+	}
+	enc := json.NewEncoder(w)
+	return enc.Encode(trace)
+}
+
+// WriteSummary writes total time of each phase with cache statistics if any module was taken from cache
+// and phase timings of the slowest modules
+func (t *Tracer) WriteSummary(w io.Writer, numSlowest int) {
+	if t == nil {
+		return
+	}
+	t.locker.Lock()
+	defer t.locker.Unlock()
+
+	p := func(format string, args ...any) {
+		_, _ = fmt.Fprintf(w, format+"\n", args...)
+	}
+
+	totals := map[Phase]time.Duration{}
+	perModule := map[ast.QualifiedIdentifier]map[Phase]time.Duration{}
+	for _, e := range t.events {
+		totals[e.phase] += e.duration
+		if e.module != "" {
+			if perModule[e.module] == nil {
+				perModule[e.module] = map[Phase]time.Duration{}
+			}
+			perModule[e.module][e.phase] += e.duration
+		}
+	}
+
+	p("compilation phases:")
+	for _, phase := range phases {
+		hits, misses := t.cacheHits[phase], t.cacheMisses[phase]
+		if hits > 0 {
+			p("  %-16s %12s  (cached modules: %d/%d)", phase, totals[phase], hits, hits+misses)
+		} else {
+			p("  %-16s %12s", phase, totals[phase])
+		}
+	}
+
+	if len(perModule) == 0 {
+		return
+	}
+	moduleTotal := func(m ast.QualifiedIdentifier) (total time.Duration) {
+		for _, d := range perModule[m] {
+			total += d
+		}
+		return
+	}
+	modules := make([]ast.QualifiedIdentifier, 0, len(perModule))
+	for m := range perModule {
+		modules = append(modules, m)
+	}
+	slices.SortFunc(modules, func(a, b ast.QualifiedIdentifier) int {
+		if c := cmp.Compare(moduleTotal(b), moduleTotal(a)); c != 0 {
+			return c
+		}
+		return cmp.Compare(a, b)
+	})
+	if len(modules) > numSlowest {
+		modules = modules[:numSlowest]
+	}
+
+	modulePhases := []Phase{PhaseParse, PhaseNormalize, PhaseTypeSolve, PhaseCompile}
+	header := fmt.Sprintf("  %-40s %12s", "slowest modules", "total")
+	for _, phase := range modulePhases {
+		header += fmt.Sprintf(" %12s", phase)
+	}
+	p("%s", strings.TrimRight(header, " "))
+	for _, m := range modules {
+		row := fmt.Sprintf("  %-40s %12s", m, moduleTotal(m))
+		for _, phase := range modulePhases {
+			row += fmt.Sprintf(" %12s", perModule[m][phase])
+		}
+		p("%s", row)
+	}
+}
@@ -0,0 +1,187 @@
+package build
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/nar-lang/nar-compiler/ast"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+type traceStep struct {
+	phase    Phase
+	module   ast.QualifiedIdentifier
+	duration time.Duration
+	counted  bool
+	cacheHit bool
+}
+
+func newTestTracer(steps []traceStep) *Tracer {
+	t := NewTracer()
+	for _, s := range steps {
+		start := time.Now().Add(-s.duration)
+		if s.counted {
+			t.RecordCached(s.phase, s.module, start, s.cacheHit)
+		} else {
+			t.Record(s.phase, s.module, start)
+		}
+	}
+	return t
+}
+
+func TestTracerSummary(t *testing.T) {
+	tests := []struct {
+		name       string
+		steps      []traceStep
+		numSlowest int
+		contains   []string
+		excludes   []string
+		modules    []string
+	}{
+		{
+			name:     "empty",
+			contains: []string{"compilation phases:", "parse", "link"},
+			excludes: []string{"slowest modules", "cached modules"},
+		},
+		{
+			name: "cache statistics are shown only with hits",
+			steps: []traceStep{
+				{phase: PhaseParse, module: "A", duration: time.Millisecond, counted: true, cacheHit: true},
+				{phase: PhaseParse, module: "B", duration: time.Millisecond, counted: true},
+				{phase: PhaseNormalize, module: "B", duration: time.Millisecond, counted: true},
+				{phase: PhaseCompile, module: "B", duration: time.Millisecond},
+			},
+			numSlowest: 10,
+			contains:   []string{"(cached modules: 1/2)"},
+			excludes:   []string{"(cached modules: 0/1)"},
+			modules:    []string{"B", "A"},
+		},
+		{
+			name: "slowest modules are sorted and limited",
+			steps: []traceStep{
+				{phase: PhaseResolve, duration: time.Hour},
+				{phase: PhaseParse, module: "Fast", duration: time.Millisecond},
+				{phase: PhaseParse, module: "Slow", duration: 3 * time.Second},
+				{phase: PhaseTypeSolve, module: "Medium", duration: time.Second},
+				{phase: PhaseCompile, module: "Medium", duration: time.Second},
+			},
+			numSlowest: 2,
+			modules:    []string{"Slow", "Medium"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := bytes.NewBuffer(nil)
+			newTestTracer(tt.steps).WriteSummary(buf, tt.numSlowest)
+			out := buf.String()
+			for _, s := range tt.contains {
+				if !strings.Contains(out, s) {
+					t.Errorf("summary does not contain %q:\n%s", s, out)
+				}
+			}
+			for _, s := range tt.excludes {
+				if strings.Contains(out, s) {
+					t.Errorf("summary contains %q:\n%s", s, out)
+				}
+			}
+			var modules []string
+			if _, rows, ok := strings.Cut(out, "slowest modules"); ok {
+				lines := strings.Split(strings.TrimSpace(rows), "\n")
+				for _, line := range lines[1:] {
+					modules = append(modules, strings.Fields(line)[0])
+				}
+			}
+			if strings.Join(modules, ",") != strings.Join(tt.modules, ",") {
+				t.Errorf("slowest modules are %v, expected %v", modules, tt.modules)
+			}
+		})
+	}
+}
+
+func TestTracerChromeTrace(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []traceStep
+		names []string
+	}{
+		{
+			name:  "empty",
+			names: []string{},
+		},
+		{
+			name: "event per module phase",
+			steps: []traceStep{
+				{phase: PhaseResolve},
+				{phase: PhaseParse, module: "A", counted: true, cacheHit: true},
+				{phase: PhaseTypeSolve, module: "A", counted: true},
+				{phase: PhaseLink},
+			},
+			names: []string{"resolve", "parse A (cached)", "type-solve A", "link"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := bytes.NewBuffer(nil)
+			if err := newTestTracer(tt.steps).WriteChromeTrace(buf); err != nil {
+				t.Fatal(err)
+			}
+			var trace chromeTrace
+			if err := json.Unmarshal(buf.Bytes(), &trace); err != nil {
+				t.Fatal(err)
+			}
+			names := []string{}
+			for _, e := range trace.TraceEvents {
+				if e.Phase != "X" {
+					t.Errorf("event %q has phase %q, expected complete event", e.Name, e.Phase)
+				}
+				names = append(names, e.Name)
+			}
+			if strings.Join(names, ",") != strings.Join(tt.names, ",") {
+				t.Errorf("events are %v, expected %v", names, tt.names)
+			}
+		})
+	}
+}
+
+func TestTracerProgress(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected int
+		steps    int
+		done     []int
+		total    []int
+	}{
+		{name: "expected steps", expected: 3, steps: 3, done: []int{1, 2, 3}, total: []int{3, 3, 3}},
+		{name: "more steps than expected", expected: 1, steps: 2, done: []int{1, 2}, total: []int{1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracer := NewTracer()
+			var done, total []int
+			tracer.Observe(func(step Step) {
+				done = append(done, step.Done)
+				total = append(total, step.Total)
+			})
+			tracer.Expect(tt.expected)
+			for i := 0; i < tt.steps; i++ {
+				tracer.Begin(PhaseParse, "A")()
+			}
+			if !slices.Equal(done, tt.done) || !slices.Equal(total, tt.total) {
+				t.Errorf("progress is %v/%v, expected %v/%v", done, total, tt.done, tt.total)
+			}
+		})
+	}
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	tracer.Expect(1)
+	tracer.Begin(PhaseParse, "A")()
+	tracer.RecordCached(PhaseParse, "A", tracer.Now(), true)
+	tracer.WriteSummary(bytes.NewBuffer(nil), 10)
+	if err := tracer.WriteChromeTrace(bytes.NewBuffer(nil)); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"github.com/nar-lang/nar-compiler/ast"
+	"github.com/nar-lang/nar-compiler/ast/parsed"
+	"github.com/nar-lang/nar-compiler/ast/typed"
+	"github.com/nar/internal/protocol"
+	"unicode"
+)
+
+func (s *server) prepareCallHierarchy(uri protocol.DocumentURI, position protocol.Position) []protocol.CallHierarchyItem {
+	loc, m, ok := s.locationUnderCursor(uri, position.Line, position.Character)
+	if !ok {
+		return nil
+	}
+	var def *typed.Definition
+	_, _, stmt := s.statementAtLocation(loc, m)
+	switch e := stmt.(type) {
+	case *typed.Global:
+		def = e.Definition()
+	case *typed.POption:
+		def = e.Definition()
+	case *typed.Definition:
+		def = e
+	}
+	if def == nil {
+		return nil
+	}
+	if item, ok := s.callHierarchyItem(def); ok {
+		return []protocol.CallHierarchyItem{item}
+	}
+	return nil
+}
+
+// incomingCalls returns definitions that reference the item grouped by caller
+func (s *server) incomingCalls(item protocol.CallHierarchyItem) []protocol.CallHierarchyIncomingCall {
+	id, ok := item.Data.(string)
+	if !ok {
+		return nil
+	}
+	var result []protocol.CallHierarchyIncomingCall
+	callers := map[ast.FullIdentifier]int{}
+	for _, use := range s.index.uses[ast.FullIdentifier(id)] {
+		if i, ok := callers[use.caller]; ok {
+			result[i].FromRanges = append(result[i].FromRanges, locToRange(use.location))
+			continue
+		}
+		caller := s.typedDefinition(use.caller)
+		if caller == nil {
+			continue
+		}
+		if from, ok := s.callHierarchyItem(caller); ok {
+			callers[use.caller] = len(result)
+			result = append(result, protocol.CallHierarchyIncomingCall{
+				From:       from,
+				FromRanges: []protocol.Range{locToRange(use.location)},
+			})
+		}
+	}
+	return result
+}
+
+// outgoingCalls returns definitions referenced by the item grouped by callee
+func (s *server) outgoingCalls(item protocol.CallHierarchyItem) []protocol.CallHierarchyOutgoingCall {
+	id, ok := item.Data.(string)
+	if !ok {
+		return nil
+	}
+	def, ok := s.parsedDefinition(ast.FullIdentifier(id))
+	if !ok {
+		return nil
+	}
+	var result []protocol.CallHierarchyOutgoingCall
+	callees := map[uint64]int{}
+	forEachGlobalReference(def, func(loc ast.Location, target *typed.Definition) {
+		if i, ok := callees[target.Id()]; ok {
+			result[i].FromRanges = append(result[i].FromRanges, locToRange(loc))
+			return
+		}
+		if to, ok := s.callHierarchyItem(target); ok {
+			callees[target.Id()] = len(result)
+			result = append(result, protocol.CallHierarchyOutgoingCall{
+				To:         to,
+				FromRanges: []protocol.Range{locToRange(loc)},
+			})
+		}
+	})
+	return result
+}
+
+func (s *server) callHierarchyItem(def *typed.Definition) (protocol.CallHierarchyItem, bool) {
+	id, ok := s.definitionIdentifier(def)
+	if !ok {
+		return protocol.CallHierarchyItem{}, false
+	}
+	kind := protocol.Function
+	if unicode.IsUpper([]rune(def.Name())[0]) {
+		kind = protocol.EnumMember
+	} else if len(def.Params()) == 0 {
+		kind = protocol.Constant
+	}
+	if pDef, ok := s.parsedDefinition(id); ok {
+		if _, native := pDef.Body().(*parsed.Call); native {
+			kind = protocol.Interface
+		}
+	}
+	return protocol.CallHierarchyItem{
+		Name:           string(def.Name()),
+		Kind:           kind,
+		Detail:         string(id[:len(id)-len(def.Name())-1]),
+		URI:            pathToUri(def.Location().FilePath()),
+		Range:          locToRange(def.Location()),
+		SelectionRange: locToRange(def.NameLocation()),
+		Data:           string(id),
+	}, true
+}
@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"fmt"
+	"github.com/nar-lang/nar-compiler/ast/parsed"
+	"github.com/nar-lang/nar-compiler/common"
+	"github.com/nar/internal/protocol"
+	"strings"
+	"unicode"
+)
+
+// codeLenses returns reference counts of the module definitions, entry point of the package gets a run lens
+// and test definitions (see isTestDefinition) get a run test lens
+func (s *server) codeLenses(uri protocol.DocumentURI, m *parsed.Module) []protocol.CodeLens {
+	var entryPoint string
+	if pvd, ok := s.getProvider(uri); ok {
+		if packages, err := pvd.ExportedPackages(); err == nil && len(packages) == 1 {
+			entryPoint = packages[0].Info().Main
+		}
+	}
+
+	var result []protocol.CodeLens
+	for _, def := range m.Definitions() {
+		if !unicode.IsLower([]rune(def.Name())[0]) {
+			continue
+		}
+		nameLoc, ok := identifierLocation(def.Location(), def.Name(), false)
+		if !ok {
+			continue
+		}
+		r := locToRange(nameLoc)
+		id := common.MakeFullIdentifier(m.Name(), def.Name())
+
+		uses := s.index.uses[id]
+		title := fmt.Sprintf("%d references", len(uses))
+		if len(uses) == 1 {
+			title = "1 reference"
+		}
+		result = append(result, protocol.CodeLens{
+			Range: r,
+			Command: &protocol.Command{
+				Title:     title,
+				Command:   commandFindReferences,
+				Arguments: commandArguments(uri, r.Start),
+			},
+		})
+
+		if string(id) == entryPoint {
+			result = append(result, protocol.CodeLens{
+				Range:   r,
+				Command: &protocol.Command{Title: "Run", Command: commandRun, Arguments: commandArguments(uri)},
+			})
+		} else if isTestDefinition(m.Location().FileContent(), def) {
+			result = append(result, protocol.CodeLens{
+				Range: r,
+				Command: &protocol.Command{
+					Title:     "Run test",
+					Command:   commandTest,
+					Arguments: commandArguments(uri, id),
+				},
+			})
+		}
+	}
+	return result
+}
+
+// testDirective marks a definition as a test when placed in the comment lines right above it
+const testDirective = "//nar:test"
+
+// isTestDefinition checks if the definition has no parameters and is marked with the test directive
+func isTestDefinition(text []rune, def parsed.Definition) bool {
+	if len(def.Params()) > 0 {
+		return false
+	}
+	lines := strings.Split(string(text[:min(int(def.Location().Start()), len(text))]), "\n")
+	// the last line is the beginning of the definition line itself
+	for i := len(lines) - 2; i >= 0; i-- {
+		line := strings.TrimSpace(lines[i])
+		if line == testDirective {
+			return true
+		}
+		if !strings.HasPrefix(line, "//") {
+			return false
+		}
+	}
+	return false
+}
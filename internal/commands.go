@@ -0,0 +1,187 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nar-lang/nar-compiler/ast"
+	"github.com/nar-lang/nar-compiler/ast/normalized"
+	"github.com/nar-lang/nar-compiler/ast/parsed"
+	"github.com/nar-lang/nar-compiler/ast/typed"
+	"github.com/nar-lang/nar-compiler/bytecode"
+	"github.com/nar-lang/nar-compiler/linker"
+	"github.com/nar-lang/nar-compiler/locator"
+	"github.com/nar-lang/nar-compiler/logger"
+	"github.com/nar/internal/build"
+	"github.com/nar/internal/protocol"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// commands executed by the client or by the server with workspace/executeCommand
+const (
+	// commandFindReferences is implemented by the client, it requests references of the symbol
+	// at the position itself, arguments are document uri and position
+	commandFindReferences = "editor.action.findReferences"
+	commandBuild          = "nar.build"
+	commandRun            = "nar.run"
+	commandTest           = "nar.test"
+	commandClearCache     = "nar.clearCache"
+)
+
+var serverCommands = []string{commandBuild, commandRun, commandTest, commandClearCache}
+
+func commandArguments(args ...any) []json.RawMessage {
+	var result []json.RawMessage
+	for _, arg := range args {
+		if data, err := json.Marshal(arg); err == nil {
+			result = append(result, data)
+		}
+	}
+	return result
+}
+
+// executeCommand runs the command for the package of the document passed as the first argument.
+// Build, run and test are executed in background, their output is sent with window/logMessage.
+func (s *server) executeCommand(params *protocol.ExecuteCommandParams) error {
+	var uri protocol.DocumentURI
+	if len(params.Arguments) == 0 || json.Unmarshal(params.Arguments[0], &uri) != nil {
+		return rpcError{Code: rpcInvalidParams, Message: "document uri is expected as the first argument"}
+	}
+	root := findPackageRoot(uriToPath(uri))
+	if root == "" {
+		return rpcError{Code: rpcRequestFailed, Message: fmt.Sprintf("%s is not inside a package", uri)}
+	}
+
+	switch params.Command {
+	case commandBuild:
+		go s.runCommand(params.WorkDoneToken, "Building "+root, func(p *progress) error {
+			return s.buildPackage(root, "", filepath.Join(root, "build", "program.binar"))
+		})
+	case commandRun:
+		go s.runCommand(params.WorkDoneToken, "Running "+root, func(p *progress) error {
+			out := filepath.Join(root, "build", "program.binar")
+			if err := s.buildPackage(root, "", out); err != nil {
+				return err
+			}
+			p.report("running")
+			return s.runProgram(out)
+		})
+	case commandTest:
+		var test string
+		if len(params.Arguments) < 2 || json.Unmarshal(params.Arguments[1], &test) != nil {
+			return rpcError{Code: rpcInvalidParams, Message: "test definition is expected as the second argument"}
+		}
+		go s.runCommand(params.WorkDoneToken, "Testing "+test, func(p *progress) error {
+			out := filepath.Join(root, "build", "test.binar")
+			if err := s.buildPackage(root, bytecode.FullIdentifier(test), out); err != nil {
+				return err
+			}
+			p.report("running")
+			return s.runProgram(out)
+		})
+	case commandClearCache:
+		s.clearCache()
+	default:
+		return rpcError{Code: rpcInvalidParams, Message: fmt.Sprintf("unknown command %s", params.Command)}
+	}
+	return nil
+}
+
+func (s *server) runCommand(token protocol.ProgressToken, title string, run func(p *progress) error) {
+	p := s.beginProgress(token, title)
+	if err := run(p); err != nil {
+		s.logMessage(protocol.Error, err.Error())
+		p.end("failed")
+		return
+	}
+	p.end("done")
+}
+
+// buildPackage compiles the package from the file system the same way command line compiler does
+// and links the program to the output file. Entry point of the package can be replaced with the given one.
+// Dependencies are resolved from workspace folders and the cache like for opened documents, build runs
+// concurrently with the compiler so it uses providers of its own.
+func (s *server) buildPackage(root string, entry bytecode.FullIdentifier, out string) error {
+	w := &logMessageWriter{s: s, type_: protocol.Info}
+	defer w.Flush()
+	log := &logger.LogWriter{OutStream: w, FailOnErr: true}
+
+	providers := []locator.Provider{locator.NewFileSystemPackageProvider(root)}
+	s.locker.Lock()
+	for _, folder := range s.workspaceFolders {
+		providers = append(providers, locator.NewDirectoryProvider(folder))
+	}
+	s.locker.Unlock()
+	providers = append(providers, locator.NewDirectoryProvider(s.cacheDir))
+
+	var lc locator.Locator = locator.NewLocator(providers...)
+	if entry != "" {
+		lc = entryPointLocator{Locator: lc, entry: entry}
+	}
+	build.CompileEx(log, lc, linker.NewDllLinker(out), true,
+		map[ast.QualifiedIdentifier]*parsed.Module{},
+		map[ast.QualifiedIdentifier]*normalized.Module{},
+		map[ast.QualifiedIdentifier]*typed.Module{},
+		nil)
+	failed := len(log.Errors()) > 0
+	log.Flush(w)
+	if failed {
+		return errors.New("compilation failed")
+	}
+	return nil
+}
+
+// runProgram executes the binar file with the nar executable the server is running from
+func (s *server) runProgram(path string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	stdout := &logMessageWriter{s: s, type_: protocol.Log}
+	stderr := &logMessageWriter{s: s, type_: protocol.Error}
+	defer stdout.Flush()
+	defer stderr.Flush()
+
+	cmd := exec.Command(exe, "-binar", path)
+	cmd.Dir = filepath.Dir(path)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return fmt.Errorf("program failed with exit code %d", exitErr.ExitCode())
+	}
+	return err
+}
+
+// clearCache drops compiled modules and recompiles opened documents from scratch
+func (s *server) clearCache() {
+	s.locker.Lock()
+	clear(s.parsedModules)
+	clear(s.normalizedModules)
+	clear(s.typedModules)
+	clear(s.semanticTokensResults)
+	s.index = newReferenceIndex()
+	var opened []protocol.DocumentURI
+	for uri := range s.openedDocuments {
+		opened = append(opened, uri)
+	}
+	s.locker.Unlock()
+
+	for _, uri := range opened {
+		s.compileChan <- docChange{uri: uri, force: true}
+	}
+}
+
+// entryPointLocator replaces entry point of the program (e.g. to run a test definition)
+type entryPointLocator struct {
+	locator.Locator
+	entry bytecode.FullIdentifier
+}
+
+func (l entryPointLocator) EntryPoint() (bytecode.FullIdentifier, error) {
+	return l.entry, nil
+}
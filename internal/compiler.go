@@ -6,8 +6,8 @@ import (
 	"fmt"
 	"github.com/nar-lang/nar-compiler/ast"
 	"github.com/nar-lang/nar-compiler/common"
-	"github.com/nar-lang/nar-compiler/compiler"
 	"github.com/nar-lang/nar-compiler/logger"
+	"github.com/nar/internal/build"
 	"github.com/nar/internal/protocol"
 	"os"
 	"runtime/debug"
@@ -42,19 +42,20 @@ func (s *server) compiler(ctx context.Context) {
 
 		s.locker.Lock()
 
-		for name, mod := range s.parsedModules {
-			for uri := range modifiedDocs {
-				path := uriToPath(uri)
-				if mod.Location().FilePath() == path {
-					delete(s.parsedModules, name)
-					delete(s.normalizedModules, name)
-					delete(s.typedModules, name)
-					modifiedPackages[mod.PackageName()] = struct{}{}
-					delete(modifiedDocs, uri)
-					break
-				}
+		var modifiedModules []ast.QualifiedIdentifier
+		for uri := range modifiedDocs {
+			if mod := s.moduleOfPath(uriToPath(uri)); mod != nil {
+				modifiedModules = append(modifiedModules, mod.Name())
+				modifiedPackages[mod.PackageName()] = struct{}{}
+				delete(modifiedDocs, uri)
 			}
 		}
+		// dependent modules are compiled again to update their types and diagnostics
+		for name := range withDependents(s.parsedModules, modifiedModules) {
+			delete(s.parsedModules, name)
+			delete(s.normalizedModules, name)
+			delete(s.typedModules, name)
+		}
 
 		for uri := range modifiedDocs {
 			delete(modifiedDocs, uri)
@@ -71,11 +72,6 @@ func (s *server) compiler(ctx context.Context) {
 		for name := range modifiedPackages {
 			delete(modifiedPackages, name)
 		}
-
-		select {
-		case s.compiledChan <- struct{}{}:
-		default:
-		}
 	}
 }
 
@@ -88,8 +84,15 @@ func (s *server) compile() {
 	}()
 	log := &logger.LogWriter{}
 
-	_, affectedModuleNames := compiler.CompileEx(
-		log, s.locator, nil, true, s.parsedModules, s.normalizedModules, s.typedModules)
+	p := s.beginProgress(nil, "Compiling")
+	defer p.end("")
+	tracer := build.NewTracer()
+	tracer.Observe(compileProgress(p))
+
+	_, affectedModuleNames := build.CompileEx(
+		log, s.locator, nil, true, s.parsedModules, s.normalizedModules, s.typedModules, tracer)
+	p.reportPercentage("", 100)
+	s.updateReferenceIndex(affectedModuleNames)
 
 	diagnosticData := s.extractDiagnosticsData(log)
 	if len(diagnosticData) == 0 {
@@ -100,20 +103,56 @@ func (s *server) compile() {
 		if mod, ok := s.parsedModules[moduleName]; ok {
 			uri := pathToUri(mod.Location().FilePath())
 			if _, reported := diagnosticData[uri]; !reported {
-				s.notify("textDocument/publishDiagnostics", protocol.PublishDiagnosticsParams{
-					URI:         uri,
-					Diagnostics: []protocol.Diagnostic{},
-				})
+				diagnosticData[uri] = []protocol.Diagnostic{}
 			}
 		}
 	}
 
+	// holes are syntax errors for the compilation above, the separate one reports their types instead
+	if holes := s.holeDiagnostics(); holes != nil {
+		diagnosticData = holes
+	}
+
+	// tokens sent while the module was not compiled are syntactic only
+	if s.semanticTokensRefresh && len(affectedModuleNames) > 0 {
+		s.request("workspace/semanticTokens/refresh", nil)
+	}
+
+	changed := s.updateDiagnostics(diagnosticData)
+	if s.pullDiagnostics {
+		if s.diagnosticsRefreshSupport && len(changed) > 0 {
+			s.request("workspace/diagnostic/refresh", nil)
+		}
+		return
+	}
+
 	for uri, dsx := range diagnosticData {
 		s.notify("textDocument/publishDiagnostics", protocol.PublishDiagnosticsParams{
 			URI:         uri,
 			Diagnostics: dsx,
 		})
 	}
+	for _, uri := range changed {
+		if _, reported := diagnosticData[uri]; !reported {
+			s.notify("textDocument/publishDiagnostics", protocol.PublishDiagnosticsParams{
+				URI:         uri,
+				Diagnostics: []protocol.Diagnostic{},
+			})
+		}
+	}
+}
+
+// compileProgress reports percentage of finished steps with the qualified name of the current module,
+// reports are sent only when the percentage changes to not flood the client
+func compileProgress(p *progress) func(step build.Step) {
+	reported := -1
+	return func(step build.Step) {
+		percentage := step.Done * 100 / step.Total
+		if step.Module != "" && percentage != reported {
+			reported = percentage
+			p.reportPercentage(string(step.Module), uint32(percentage))
+		}
+	}
 }
 
 func (s *server) extractDiagnosticsData(log *logger.LogWriter) map[protocol.DocumentURI][]protocol.Diagnostic {
@@ -0,0 +1,735 @@
+package internal
+
+import (
+	"fmt"
+	"github.com/nar-lang/nar-compiler"
+	"github.com/nar-lang/nar-compiler/ast"
+	"github.com/nar-lang/nar-compiler/ast/normalized"
+	"github.com/nar-lang/nar-compiler/ast/parsed"
+	"github.com/nar-lang/nar-compiler/ast/typed"
+	"github.com/nar-lang/nar-compiler/common"
+	"github.com/nar/internal/protocol"
+	"strings"
+	"unicode"
+)
+
+// completion items are ranked by the scope they come from
+const (
+	scopeLocal = iota
+	scopeModule
+	scopeImported
+	scopeGlobal
+	scopeKeyword
+)
+
+// keywordSnippets expand keywords of compound expressions to templates
+var keywordSnippets = map[string]string{
+	nar_compiler.KwSelect: "select ${1:value}\n\tcase ${2:pattern} -> ${3:result}\nend",
+	nar_compiler.KwLet:    "let ${1:name} = ${2:value}\nin $0",
+	nar_compiler.KwIf:     "if ${1:condition} then ${2:value} else ${3:otherwise}",
+}
+
+func (s *server) completion(uri protocol.DocumentURI, position protocol.Position) []protocol.CompletionItem {
+	loc, module, ok := s.locationUnderCursor(uri, position.Line, position.Character)
+	if !ok {
+		return nil
+	}
+	text := s.documentText(uri, module)
+	cursor := int(ast.NewLocationSrc(loc.FilePath(), text, position.Line, position.Character).Start())
+
+	if qualifier := qualifierAt(text, cursor); qualifier != "" {
+		if items := s.qualifiedCompletions(module, qualifier); len(items) > 0 {
+			return items
+		}
+		return s.fieldCompletions(module, loc, qualifier)
+	}
+	if subject := recordUpdateSubject(text, cursor); subject != "" {
+		return s.fieldCompletions(module, loc, subject)
+	}
+	items := s.scopeCompletions(module, loc, text)
+	if expected := s.expectedType(module, loc, text, cursor); expected != nil {
+		s.rankByType(items, module, loc, expected)
+	}
+	return items
+}
+
+// scopeCompletions returns all names visible at the location ranked from local variables to keywords.
+// Names of modules that are not imported (or not exposed by import) come with the edit that imports them.
+func (s *server) scopeCompletions(module *parsed.Module, loc ast.Location, text []rune) []protocol.CompletionItem {
+	var items []protocol.CompletionItem
+
+	localItems := map[ast.Identifier]struct{}{}
+	var appendLocals func(locals ...normalized.Pattern)
+	appendLocals = func(locals ...normalized.Pattern) {
+		for _, p := range locals {
+			switch p.(type) {
+			case *normalized.PAlias:
+				localItems[p.(*normalized.PAlias).Alias()] = struct{}{}
+				appendLocals(p.(*normalized.PAlias).Nested())
+			case *normalized.PCons:
+				appendLocals(p.(*normalized.PCons).Head(), p.(*normalized.PCons).Tail())
+			case *normalized.PList:
+				appendLocals(p.(*normalized.PList).Items()...)
+			case *normalized.PNamed:
+				localItems[p.(*normalized.PNamed).Name()] = struct{}{}
+			case *normalized.POption:
+				appendLocals(p.(*normalized.POption).Values()...)
+			case *normalized.PRecord:
+				for _, f := range p.(*normalized.PRecord).Fields() {
+					localItems[f.Name()] = struct{}{}
+				}
+			case *normalized.PTuple:
+				appendLocals(p.(*normalized.PTuple).Items()...)
+			}
+		}
+	}
+
+	module.Iterate(func(stmt parsed.Statement) {
+		if stmt.Location().Contains(loc) {
+			nStmt := stmt.Successor()
+			switch nStmt.(type) {
+			case normalized.Definition:
+				appendLocals(nStmt.(normalized.Definition).Params()...)
+			case *normalized.Let:
+				appendLocals(nStmt.(*normalized.Let).Pattern())
+			case *normalized.Select:
+				for _, cs := range nStmt.(*normalized.Select).Cases() {
+					if cs.Location().Contains(loc) {
+						appendLocals(cs.Pattern())
+					}
+				}
+			}
+		}
+	})
+	for name := range localItems {
+		items = append(items, completionItem(string(name), protocol.VariableCompletion, "", scopeLocal))
+	}
+
+	imports, _ := scanImports(text)
+	visibleNames := map[ast.Identifier]ast.QualifiedIdentifier{}
+	for _, imp := range imports {
+		if m, ok := s.parsedModules[imp.module]; ok && m != nil {
+			for _, member := range moduleMembers(m, false) {
+				if imp.exposes(member.exposedAs) {
+					visibleNames[member.name] = m.Name()
+				}
+			}
+		}
+	}
+	for _, member := range moduleMembers(module, true) {
+		visibleNames[member.name] = module.Name()
+	}
+
+	resolved := map[ast.QualifiedIdentifier]*parsed.Module{}
+	resolvesTo := func(name ast.Identifier, m *parsed.Module) bool {
+		qName := ast.QualifiedIdentifier(name)
+		target, ok := resolved[qName]
+		if !ok {
+			if _, defModule, ids := module.FindDefinition(s.parsedModules, qName); len(ids) == 1 {
+				target = defModule
+			}
+			resolved[qName] = target
+		}
+		return target == m
+	}
+
+	for _, m := range s.parsedModules {
+		if m == nil {
+			continue
+		}
+		isCurrentModule := m == module
+		imp, isImported := common.Find(func(i importStatement) bool { return i.module == m.Name() }, imports)
+		scope := scopeGlobal
+		if isCurrentModule {
+			scope = scopeModule
+		} else if isImported {
+			scope = scopeImported
+		}
+
+		qualifier := string(m.Name())
+		if isImported && imp.alias != "" {
+			qualifier = string(imp.alias)
+		}
+
+		for _, member := range moduleMembers(m, isCurrentModule) {
+			item := completionItem(
+				string(member.name), member.kind, fmt.Sprintf(" %s.%s", m.Name(), member.name), scope)
+			visibleFrom, shadowed := visibleNames[member.name]
+			switch {
+			case visibleFrom == m.Name():
+			case member.definition && !shadowed && resolvesTo(member.name, m):
+			case !shadowed:
+				if edit, ok := importEdit(loc.FilePath(), text, m.Name(), member.exposedAs); ok {
+					item.AdditionalTextEdits = []protocol.TextEdit{edit}
+					item.LabelDetails.Description = string(m.Name())
+				}
+			default:
+				item.Label = fmt.Sprintf("%s.%s", qualifier, member.name)
+				item.SortText = sortText(scope, item.Label)
+			}
+			items = append(items, withCallSnippet(item, m, member, module.Name()))
+		}
+		if isCurrentModule || isImported {
+			for _, ifx := range m.InfixFns() {
+				items = append(items, completionItem(string(ifx.Name()), protocol.OperatorCompletion, "", scope))
+			}
+		}
+		if isImported {
+			items = append(items, completionItem(qualifier, protocol.ModuleCompletion, "", scope))
+		}
+	}
+
+	for _, k := range keywordCompletions {
+		k.SortText = sortText(scopeKeyword, k.Label)
+		items = append(items, k)
+	}
+	return items
+}
+
+// qualifiedCompletions returns members of the modules referenced by qualifier (full module name,
+// import alias or last segment of imported module name) and names of its submodules
+func (s *server) qualifiedCompletions(module *parsed.Module, qualifier ast.QualifiedIdentifier) []protocol.CompletionItem {
+	var items []protocol.CompletionItem
+	submodules := map[string]struct{}{}
+
+	for _, m := range s.parsedModules {
+		if m == nil {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(string(m.Name()), string(qualifier)+"."); ok {
+			segment, _, _ := strings.Cut(rest, ".")
+			submodules[segment] = struct{}{}
+		}
+
+		isCurrentModule := m == module
+		imp, isImported := common.Find(func(i parsed.Import) bool { return i.Module() == m.Name() }, module.Imports())
+		matches := m.Name() == qualifier
+		if isImported && !matches {
+			if imp.Alias() != nil {
+				matches = ast.QualifiedIdentifier(*imp.Alias()) == qualifier
+			} else {
+				matches = strings.HasSuffix(string(m.Name()), "."+string(qualifier))
+			}
+		}
+		if !matches {
+			continue
+		}
+
+		scope := scopeGlobal
+		if isCurrentModule {
+			scope = scopeModule
+		} else if isImported {
+			scope = scopeImported
+		}
+		for _, member := range moduleMembers(m, isCurrentModule) {
+			item := completionItem(
+				string(member.name), member.kind, fmt.Sprintf(" %s.%s", m.Name(), member.name), scope)
+			items = append(items, withCallSnippet(item, m, member, module.Name()))
+		}
+	}
+
+	for segment := range submodules {
+		items = append(items, completionItem(segment, protocol.ModuleCompletion, "", scopeGlobal))
+	}
+	return items
+}
+
+type moduleMember struct {
+	name       ast.Identifier
+	exposedAs  ast.Identifier // name in the exposing list of import that makes member visible
+	kind       protocol.CompletionItemKind
+	definition bool
+}
+
+// moduleMembers lists definitions, type aliases, data types and their options of the module.
+// Aliases and constructors generated for data types are listed only once as data types and options.
+func moduleMembers(m *parsed.Module, withHidden bool) []moduleMember {
+	var members []moduleMember
+	dataTypes := map[ast.Identifier]struct{}{}
+	options := map[ast.Identifier]struct{}{}
+	for _, dt := range m.DataTypes() {
+		dataTypes[dt.Name()] = struct{}{}
+		for _, opt := range dt.Options() {
+			options[opt.Name()] = struct{}{}
+		}
+	}
+
+	for _, def := range m.Definitions() {
+		if _, ok := options[def.Name()]; !ok && (withHidden || !def.Hidden()) {
+			kind := protocol.FunctionCompletion
+			if len(def.Params()) == 0 {
+				kind = protocol.ConstantCompletion
+			}
+			members = append(members, moduleMember{name: def.Name(), exposedAs: def.Name(), kind: kind, definition: true})
+		}
+	}
+	for _, alias := range m.Aliases() {
+		if _, ok := dataTypes[alias.Name()]; !ok && (withHidden || !alias.Hidden()) {
+			members = append(members, moduleMember{name: alias.Name(), exposedAs: alias.Name(), kind: protocol.ClassCompletion})
+		}
+	}
+	for _, dt := range m.DataTypes() {
+		if withHidden || !dt.Hidden() {
+			members = append(members, moduleMember{name: dt.Name(), exposedAs: dt.Name(), kind: protocol.EnumCompletion})
+			for _, opt := range dt.Options() {
+				if withHidden || !opt.Hidden() {
+					members = append(members,
+						moduleMember{
+							name: opt.Name(), exposedAs: dt.Name(), kind: protocol.EnumMemberCompletion, definition: true,
+						})
+				}
+			}
+		}
+	}
+	return members
+}
+
+// withCallSnippet makes the item insert a call of the member with placeholder for each parameter
+// (parameter names of functions and value types of data options) and marks it for lazy resolving
+func withCallSnippet(
+	item protocol.CompletionItem, m *parsed.Module, member moduleMember, currentModule ast.QualifiedIdentifier,
+) protocol.CompletionItem {
+	item.Data = string(common.MakeFullIdentifier(m.Name(), member.name))
+	if !member.definition {
+		return item
+	}
+	def, ok := common.Find(func(d parsed.Definition) bool { return d.Name() == member.name }, m.Definitions())
+	if !ok || len(def.Params()) == 0 {
+		return item
+	}
+	var tDef *typed.Definition
+	if nDef := def.Successor(); nDef != nil {
+		tDef, _ = nDef.Successor().(*typed.Definition)
+	}
+
+	sb := strings.Builder{}
+	sb.WriteString(escapeSnippet(item.Label))
+	sb.WriteString("(")
+	for i, p := range def.Params() {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		placeholder := "_"
+		if named, ok := p.(*parsed.PNamed); ok && member.kind != protocol.EnumMemberCompletion {
+			placeholder = string(named.Name())
+		} else if tDef != nil && i < len(tDef.Params()) && tDef.Params()[i].Type() != nil {
+			placeholder = tDef.Params()[i].Type().Code(currentModule)
+		}
+		sb.WriteString(fmt.Sprintf("${%d:%s}", i+1, escapeSnippet(placeholder)))
+	}
+	sb.WriteString(")")
+
+	format := protocol.SnippetTextFormat
+	item.InsertText = sb.String()
+	item.InsertTextFormat = &format
+	return item
+}
+
+func escapeSnippet(text string) string {
+	return strings.NewReplacer(`\`, `\\`, `$`, `\$`, `}`, `\}`).Replace(text)
+}
+
+// resolveCompletion adds full signature and documentation to the item of module member
+func (s *server) resolveCompletion(item *protocol.CompletionItem, id ast.FullIdentifier) {
+	lastDot := strings.LastIndex(string(id), ".")
+	if lastDot < 0 {
+		return
+	}
+	m, ok := s.parsedModules[ast.QualifiedIdentifier(id[:lastDot])]
+	if !ok || m == nil {
+		return
+	}
+	name := ast.Identifier(id[lastDot+1:])
+
+	var loc ast.Location
+	keyword := ""
+	if def, ok := common.Find(func(d parsed.Definition) bool { return d.Name() == name }, m.Definitions()); ok {
+		loc = def.Location()
+		if nDef := def.Successor(); nDef != nil {
+			if tDef, ok := nDef.Successor().(*typed.Definition); ok && tDef != nil {
+				item.Detail = definitionSignature(tDef, m.Name(), def, m.Name())
+				loc = tDef.Location()
+			}
+		}
+	} else if dt, ok := common.Find(func(d parsed.DataType) bool { return d.Name() == name }, m.DataTypes()); ok {
+		loc = dt.Location()
+		keyword = nar_compiler.KwType
+	} else if alias, ok := common.Find(func(a parsed.Alias) bool { return a.Name() == name }, m.Aliases()); ok {
+		loc = alias.Location()
+		keyword = nar_compiler.KwAlias
+	} else {
+		return
+	}
+
+	if item.Detail == "" {
+		item.Detail, _, _ = strings.Cut(loc.Text(), "\n")
+		item.Detail = strings.TrimSpace(item.Detail)
+		if keyword != "" && !strings.HasPrefix(item.Detail, keyword+" ") {
+			item.Detail = keyword + " " + item.Detail
+		}
+	}
+	if doc := docComment(loc); doc != "" {
+		item.Documentation = &protocol.Or_CompletionItem_documentation{
+			Value: protocol.MarkupContent{Kind: protocol.Markdown, Value: doc},
+		}
+	}
+}
+
+// fieldCompletions returns fields of the record that path (e.g. `r` or `r.nested`) refers to
+func (s *server) fieldCompletions(
+	module *parsed.Module, loc ast.Location, path ast.QualifiedIdentifier,
+) []protocol.CompletionItem {
+	names := strings.Split(string(path), ".")
+	t := s.typeOfName(module, loc, ast.Identifier(names[0]))
+	for _, name := range names[1:] {
+		record, ok := t.(*typed.TRecord)
+		if !ok {
+			return nil
+		}
+		t = record.Fields()[ast.Identifier(name)]
+	}
+	record, ok := t.(*typed.TRecord)
+	if !ok {
+		return nil
+	}
+
+	var items []protocol.CompletionItem
+	for name, fieldType := range record.Fields() {
+		item := completionItem(string(name), protocol.FieldCompletion, "", scopeLocal)
+		item.Detail = fieldType.Code(module.Name())
+		items = append(items, item)
+	}
+	return items
+}
+
+// typeOfName returns inferred type of the closest local variable declared before the location
+// or of the global constant with given name
+func (s *server) typeOfName(module *parsed.Module, loc ast.Location, name ast.Identifier) typed.Type {
+	var found typed.Pattern
+	var foundAt uint32
+	if def, ok := common.Find(
+		func(d parsed.Definition) bool { return d.Location().Contains(loc) }, module.Definitions(),
+	); ok {
+		def.Iterate(func(stmt parsed.Statement) {
+			if stmt == nil || stmt.Location().Start() > loc.Start() {
+				return
+			}
+			nStmt := stmt.Successor()
+			matches := false
+			switch p := nStmt.(type) {
+			case *normalized.PNamed:
+				matches = p.Name() == name
+			case *normalized.PAlias:
+				matches = p.Alias() == name
+			}
+			if matches && (found == nil || stmt.Location().Start() >= foundAt) {
+				if tp, ok := nStmt.Successor().(typed.Pattern); ok && tp != nil {
+					found = tp
+					foundAt = stmt.Location().Start()
+				}
+			}
+		})
+	}
+	if found != nil {
+		return found.Type()
+	}
+
+	if def, _, _ := module.FindDefinition(s.parsedModules, ast.QualifiedIdentifier(name)); def != nil {
+		if nDef := def.Successor(); nDef != nil {
+			if tDef, ok := nDef.Successor().(*typed.Definition); ok && tDef != nil && len(tDef.Params()) == 0 {
+				return definitionReturnType(tDef)
+			}
+		}
+	}
+	return nil
+}
+
+// expectedType returns type that the expression at the cursor should have judging by argument position
+// of the enclosing call, value of the enclosing let binding or case of the enclosing select.
+// Returns nil if the type is unknown or does not restrict the candidates.
+func (s *server) expectedType(module *parsed.Module, loc ast.Location, text []rune, cursor int) typed.Type {
+	var expected typed.Type
+	callOpen := -1
+	if open, index, ok := enclosingCall(text, cursor); ok {
+		if start, end := calleeIdentifier(text, open); start < end {
+			if fn, ok := s.calleeType(loc.FilePath(), text, start, end, module).(*typed.TFunc); ok &&
+				int(index) < fn.NumParams() {
+				expected = fn.ParamAt(int(index))
+				callOpen = open
+			}
+		}
+	}
+
+	var enclosing parsed.Statement
+	module.Iterate(func(stmt parsed.Statement) {
+		switch stmt.(type) {
+		case *parsed.Let, *parsed.Select:
+			if stmt.Location().Contains(loc) &&
+				(enclosing == nil || enclosing.Location().Size() > stmt.Location().Size()) {
+				enclosing = stmt
+			}
+		}
+	})
+	if enclosing != nil && int(enclosing.Location().Start()) > callOpen {
+		expected = nil
+		if nStmt := enclosing.Successor(); nStmt != nil {
+			switch e := nStmt.Successor().(type) {
+			case *typed.Let:
+				ch := e.Children()
+				pattern, value, body := ch[len(ch)-3].(typed.Pattern), ch[len(ch)-2], ch[len(ch)-1]
+				if value.Location().Contains(loc) {
+					expected = pattern.Type()
+				} else if body.Location().Contains(loc) {
+					expected = e.Type()
+				}
+			case *typed.Select:
+				// children are select type, condition and pairs of case pattern and expression
+				ch := e.Children()
+				condition := ch[1]
+				for i := 2; i+1 < len(ch); i += 2 {
+					if ch[i].Location().Contains(loc) {
+						expected = condition.(typed.Expression).Type()
+					} else if ch[i+1].Location().Contains(loc) {
+						expected = e.Type()
+					}
+				}
+			}
+		}
+	}
+
+	if _, ok := expected.(*typed.TUnbound); ok {
+		return nil
+	}
+	return expected
+}
+
+// calleeType returns type of the value referenced by identifier text[start:end]
+func (s *server) calleeType(path string, text []rune, start int, end int, m *parsed.Module) typed.Type {
+	identLoc := ast.NewLocationCursor(path, text, uint32(end-1))
+	if _, _, stmt := s.statementAtLocation(identLoc, m); stmt != nil {
+		switch e := stmt.(type) {
+		case *typed.Global, *typed.Local, *typed.POption:
+			return e.(typed.Expression).Type()
+		}
+	}
+	return nil
+}
+
+// rankByType moves items whose type unifies with the expected type to the top preserving scope order
+func (s *server) rankByType(
+	items []protocol.CompletionItem, module *parsed.Module, loc ast.Location, expected typed.Type,
+) {
+	for i, item := range items {
+		matches := false
+		switch {
+		case item.Data != nil:
+			if tDef := s.typedDefinition(ast.FullIdentifier(item.Data.(string))); tDef != nil {
+				matches = definitionMatchesType(tDef, expected)
+			}
+		case item.Kind == protocol.VariableCompletion:
+			matches = typesUnify(expected, s.typeOfName(module, loc, ast.Identifier(item.Label)))
+		}
+		if matches {
+			items[i].SortText = "0" + item.SortText
+		} else {
+			items[i].SortText = "1" + item.SortText
+		}
+	}
+}
+
+// parsedDefinition returns parsed definition by its full identifier
+func (s *server) parsedDefinition(id ast.FullIdentifier) (parsed.Definition, bool) {
+	lastDot := strings.LastIndex(string(id), ".")
+	if lastDot < 0 {
+		return nil, false
+	}
+	m, ok := s.parsedModules[ast.QualifiedIdentifier(id[:lastDot])]
+	if !ok || m == nil {
+		return nil, false
+	}
+	name := ast.Identifier(id[lastDot+1:])
+	return common.Find(func(d parsed.Definition) bool { return d.Name() == name }, m.Definitions())
+}
+
+// typedDefinition returns typed definition by its full identifier
+func (s *server) typedDefinition(id ast.FullIdentifier) *typed.Definition {
+	def, ok := s.parsedDefinition(id)
+	if !ok {
+		return nil
+	}
+	if nDef := def.Successor(); nDef != nil {
+		if tDef, ok := nDef.Successor().(*typed.Definition); ok && tDef != nil {
+			return tDef
+		}
+	}
+	return nil
+}
+
+// definitionMatchesType checks if the definition itself or result of its call can be used as a value of given type
+func definitionMatchesType(def *typed.Definition, t typed.Type) bool {
+	if typesUnify(t, definitionReturnType(def)) {
+		return true
+	}
+	fn, ok := t.(*typed.TFunc)
+	if !ok || len(def.Params()) == 0 || fn.NumParams() != len(def.Params()) {
+		return false
+	}
+	for i, p := range def.Params() {
+		if !typesUnify(fn.ParamAt(i), p.Type()) {
+			return false
+		}
+	}
+	return typesUnify(fn.Return(), definitionReturnType(def))
+}
+
+// typesUnify is a loose structural check that two types can be unified,
+// type variables match anything and type arguments of data types are not compared
+func typesUnify(a typed.Type, b typed.Type) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	if _, ok := a.(*typed.TUnbound); ok {
+		return true
+	}
+	if _, ok := b.(*typed.TUnbound); ok {
+		return true
+	}
+	switch x := a.(type) {
+	case *typed.TNative:
+		y, ok := b.(*typed.TNative)
+		return ok && x.Name() == y.Name() && childTypesUnify(x.Children(), y.Children())
+	case *typed.TData:
+		y, ok := b.(*typed.TData)
+		return ok && x.Name() == y.Name()
+	case *typed.TTuple:
+		y, ok := b.(*typed.TTuple)
+		return ok && childTypesUnify(x.Children(), y.Children())
+	case *typed.TFunc:
+		y, ok := b.(*typed.TFunc)
+		if !ok || x.NumParams() != y.NumParams() {
+			return false
+		}
+		for i := 0; i < x.NumParams(); i++ {
+			if !typesUnify(x.ParamAt(i), y.ParamAt(i)) {
+				return false
+			}
+		}
+		return typesUnify(x.Return(), y.Return())
+	case *typed.TRecord:
+		y, ok := b.(*typed.TRecord)
+		if !ok {
+			return false
+		}
+		for name, f := range x.Fields() {
+			if g, ok := y.Fields()[name]; ok && !typesUnify(f, g) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func childTypesUnify(a []typed.Statement, b []typed.Statement) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		x, _ := a[i].(typed.Type)
+		y, _ := b[i].(typed.Type)
+		if !typesUnify(x, y) {
+			return false
+		}
+	}
+	return true
+}
+
+func completionItem(label string, kind protocol.CompletionItemKind, detail string, scope int) protocol.CompletionItem {
+	item := protocol.CompletionItem{
+		Label:    label,
+		Kind:     kind,
+		SortText: sortText(scope, label),
+	}
+	if detail != "" {
+		item.LabelDetails = &protocol.CompletionItemLabelDetails{Detail: detail}
+	}
+	return item
+}
+
+func sortText(scope int, label string) string {
+	return fmt.Sprintf("%d%s", scope, label)
+}
+
+// qualifierAt returns the part of the dotted name under the cursor before the last dot
+func qualifierAt(text []rune, cursor int) ast.QualifiedIdentifier {
+	if cursor > len(text) {
+		cursor = len(text)
+	}
+	start := cursor
+	for start > 0 && isIdentChar(text[start-1]) {
+		start--
+	}
+	word := string(text[start:cursor])
+	lastDot := strings.LastIndex(word, ".")
+	if lastDot <= 0 {
+		return ""
+	}
+	return ast.QualifiedIdentifier(word[:lastDot])
+}
+
+// recordUpdateSubject returns name of the updated record if the cursor is at the field name
+// position of the record update expression `{ r | field = value, ... }`
+func recordUpdateSubject(text []rune, cursor int) ast.QualifiedIdentifier {
+	if cursor > len(text) {
+		cursor = len(text)
+	}
+	depth := 0
+	atFieldName := false
+	for i := cursor - 1; i >= 0; i-- {
+		switch text[i] {
+		case ')', ']', '}':
+			depth++
+		case '(', '[', '{':
+			if depth == 0 {
+				return ""
+			}
+			depth--
+		case '=':
+			if depth == 0 && !atFieldName {
+				return ""
+			}
+		case ',':
+			if depth == 0 {
+				atFieldName = true
+			}
+		case '|':
+			if depth == 0 {
+				atFieldName = true
+				if subject := recordUpdateHead(text[:i]); subject != "" {
+					return subject
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// recordUpdateHead returns `r` if text ends with `{ r `
+func recordUpdateHead(text []rune) ast.QualifiedIdentifier {
+	end := len(text)
+	for end > 0 && unicode.IsSpace(text[end-1]) {
+		end--
+	}
+	start := end
+	for start > 0 && isIdentChar(text[start-1]) {
+		start--
+	}
+	brace := start
+	for brace > 0 && unicode.IsSpace(text[brace-1]) {
+		brace--
+	}
+	if start == end || brace == 0 || text[brace-1] != '{' {
+		return ""
+	}
+	return ast.QualifiedIdentifier(text[start:end])
+}
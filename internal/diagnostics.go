@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"fmt"
+	"github.com/nar/internal/protocol"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+)
+
+// diagnosticReport is the last diagnostics of the document, result id changes only when diagnostics change
+type diagnosticReport struct {
+	id    string
+	items []protocol.Diagnostic
+}
+
+// updateDiagnostics stores diagnostics of compiled documents and drops reports of documents
+// that are not loaded anymore, it returns documents which diagnostics were changed
+func (s *server) updateDiagnostics(reports map[protocol.DocumentURI][]protocol.Diagnostic) []protocol.DocumentURI {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	var changed []protocol.DocumentURI
+	for uri, items := range reports {
+		if report, ok := s.diagnostics[uri]; ok && reflect.DeepEqual(report.items, items) {
+			continue
+		}
+		s.lastDiagnosticsId++
+		s.diagnostics[uri] = diagnosticReport{id: fmt.Sprintf("%d", s.lastDiagnosticsId), items: items}
+		changed = append(changed, uri)
+	}
+	for uri := range s.diagnostics {
+		if _, reported := reports[uri]; !reported && s.moduleOfPath(uriToPath(uri)) == nil {
+			delete(s.diagnostics, uri)
+			changed = append(changed, uri)
+		}
+	}
+	return changed
+}
+
+// documentDiagnostic returns diagnostics of the document or reports that they are not changed since previous result
+func (s *server) documentDiagnostic(uri protocol.DocumentURI, previousId string) protocol.DocumentDiagnosticReport {
+	s.locker.Lock()
+	report, ok := s.diagnostics[uri]
+	s.locker.Unlock()
+
+	if ok && report.id == previousId {
+		return protocol.DocumentDiagnosticReport{Value: protocol.RelatedUnchangedDocumentDiagnosticReport{
+			UnchangedDocumentDiagnosticReport: protocol.UnchangedDocumentDiagnosticReport{
+				Kind: string(protocol.DiagnosticUnchanged), ResultID: report.id,
+			},
+		}}
+	}
+	return protocol.DocumentDiagnosticReport{Value: protocol.RelatedFullDocumentDiagnosticReport{
+		FullDocumentDiagnosticReport: fullDiagnosticReport(report),
+	}}
+}
+
+// workspaceDiagnostic returns diagnostics of source files of all packages inside workspace folders.
+// Packages that are not loaded yet are added to compilation, their files are reported after it finishes.
+func (s *server) workspaceDiagnostic(previousIds []protocol.PreviousResultID) protocol.WorkspaceDiagnosticReport {
+	previous := map[protocol.DocumentURI]string{}
+	for _, p := range previousIds {
+		previous[p.URI] = p.Value
+	}
+
+	s.locker.Lock()
+	var loaded []string
+	var paths []string
+	for _, root := range s.workspacePackageRoots() {
+		if _, ok := s.provides[root]; !ok {
+			s.provides[root] = newProvider(root)
+			loaded = append(loaded, root)
+		}
+		paths = append(paths, packageSourcePaths(root)...)
+	}
+	if len(loaded) > 0 {
+		s.updateLocator()
+	}
+
+	result := protocol.WorkspaceDiagnosticReport{Items: []protocol.WorkspaceDocumentDiagnosticReport{}}
+	for _, path := range paths {
+		uri := pathToUri(path)
+		report, ok := s.diagnostics[uri]
+		if !ok && s.moduleOfPath(path) == nil {
+			continue
+		}
+		if report.id != "" && previous[uri] == report.id {
+			result.Items = append(result.Items, protocol.WorkspaceDocumentDiagnosticReport{
+				Value: protocol.WorkspaceUnchangedDocumentDiagnosticReport{
+					URI:     uri,
+					Version: s.documentVersions[uri],
+					UnchangedDocumentDiagnosticReport: protocol.UnchangedDocumentDiagnosticReport{
+						Kind: string(protocol.DiagnosticUnchanged), ResultID: report.id,
+					},
+				},
+			})
+		} else {
+			result.Items = append(result.Items, protocol.WorkspaceDocumentDiagnosticReport{
+				Value: protocol.WorkspaceFullDocumentDiagnosticReport{
+					URI:                          uri,
+					Version:                      s.documentVersions[uri],
+					FullDocumentDiagnosticReport: fullDiagnosticReport(report),
+				},
+			})
+		}
+	}
+	s.locker.Unlock()
+
+	for _, root := range loaded {
+		s.compileChan <- docChange{uri: pathToUri(filepath.Join(root, "nar.json")), force: true}
+	}
+	return result
+}
+
+// workspacePackageRoots returns roots of packages that are workspace folders themselves or their
+// subdirectories the same way directory providers find them, the caller holds the lock
+func (s *server) workspacePackageRoots() []string {
+	isPackage := func(path string) bool {
+		_, err := os.Stat(filepath.Join(path, "nar.json"))
+		return err == nil
+	}
+	var roots []string
+	for _, folder := range s.workspaceFolders {
+		if isPackage(folder) && !slices.Contains(roots, folder) {
+			roots = append(roots, folder)
+		}
+		dirs, _ := os.ReadDir(folder)
+		for _, dir := range dirs {
+			path := filepath.Join(folder, dir.Name())
+			if (dir.IsDir() || dir.Type()&os.ModeSymlink != 0) && isPackage(path) && !slices.Contains(roots, path) {
+				roots = append(roots, path)
+			}
+		}
+	}
+	return roots
+}
+
+// packageSourcePaths returns paths of source files of the package the same way the compiler loads them
+func packageSourcePaths(root string) []string {
+	var paths []string
+	_ = filepath.WalkDir(filepath.Join(root, "src"), func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && filepath.Ext(path) == ".nar" {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	return paths
+}
+
+func fullDiagnosticReport(report diagnosticReport) protocol.FullDocumentDiagnosticReport {
+	items := report.items
+	if items == nil {
+		items = []protocol.Diagnostic{}
+	}
+	return protocol.FullDocumentDiagnosticReport{
+		Kind:     string(protocol.DiagnosticFull),
+		ResultID: report.id,
+		Items:    items,
+	}
+}
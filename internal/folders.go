@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"github.com/nar-lang/nar-compiler/ast"
+	"github.com/nar-lang/nar-compiler/locator"
+	"github.com/nar/internal/protocol"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// changeWorkspaceFolders updates providers of workspace folders, drops modules and packages of removed
+// folders along with modules depending on them and recompiles opened documents so diagnostics are updated
+func (s *server) changeWorkspaceFolders(event protocol.WorkspaceFoldersChangeEvent) {
+	s.locker.Lock()
+	var changed []protocol.DocumentURI
+	var dropped []ast.QualifiedIdentifier
+	openedRoots := map[string]struct{}{}
+	for _, root := range s.documentToPackageRoot {
+		openedRoots[root] = struct{}{}
+	}
+	for _, f := range event.Removed {
+		folder := uriToPath(protocol.DocumentURI(f.URI))
+		isInFolder := func(path string) bool {
+			return path == folder || strings.HasPrefix(path, folder+string(filepath.Separator))
+		}
+		s.workspaceFolders = slices.DeleteFunc(s.workspaceFolders, func(x string) bool { return x == folder })
+		for path, name := range s.index.paths {
+			if isInFolder(path) {
+				dropped = append(dropped, name)
+				changed = append(changed, pathToUri(path))
+			}
+		}
+		// packages of opened documents are still provided by the client
+		for root := range s.provides {
+			if _, opened := openedRoots[root]; isInFolder(root) && !opened {
+				delete(s.provides, root)
+				delete(s.packageRootToName, root)
+			}
+		}
+	}
+	for name := range withDependents(s.parsedModules, dropped) {
+		if m, ok := s.parsedModules[name]; ok {
+			changed = append(changed, pathToUri(m.Location().FilePath()))
+		}
+		delete(s.parsedModules, name)
+		delete(s.normalizedModules, name)
+		delete(s.typedModules, name)
+	}
+	for _, f := range event.Added {
+		folder := uriToPath(protocol.DocumentURI(f.URI))
+		if !slices.Contains(s.workspaceFolders, folder) {
+			s.workspaceFolders = append(s.workspaceFolders, folder)
+		}
+	}
+
+	s.workspaceProviders = nil
+	for _, folder := range s.workspaceFolders {
+		s.workspaceProviders = append(s.workspaceProviders, locator.NewDirectoryProvider(folder))
+	}
+	s.updateLocator()
+
+	for uri := range s.openedDocuments {
+		changed = append(changed, uri)
+	}
+	s.locker.Unlock()
+
+	for _, uri := range changed {
+		s.compileChan <- docChange{uri: uri, force: true}
+	}
+}
@@ -0,0 +1,234 @@
+package internal
+
+import (
+	"github.com/nar-lang/nar-compiler/ast"
+	"github.com/nar-lang/nar-compiler/ast/normalized"
+	"github.com/nar-lang/nar-compiler/ast/parsed"
+	"github.com/nar-lang/nar-compiler/common"
+	"github.com/nar/internal/protocol"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// foldingRanges returns multi-line definitions, expressions, import groups and comment blocks of the module
+func foldingRanges(m *parsed.Module) []protocol.FoldingRange {
+	text := m.Location().FileContent()
+	var result []protocol.FoldingRange
+	fold := func(start, end int, kind protocol.FoldingRangeKind) {
+		startLine, endLine := lineAt(text, start), lineAt(text, end)
+		if endLine > startLine {
+			result = append(result, protocol.FoldingRange{StartLine: startLine, EndLine: endLine, Kind: string(kind)})
+		}
+	}
+	foldLocation := func(loc ast.Location) {
+		loc = trimLocation(loc)
+		fold(int(loc.Start()), int(loc.End()), "")
+	}
+
+	for _, def := range m.Definitions() {
+		foldLocation(def.Location())
+	}
+	m.Iterate(func(stmt parsed.Statement) {
+		switch e := stmt.(type) {
+		case *parsed.Select:
+			foldLocation(e.Location())
+			for _, cs := range selectCaseLocations(e) {
+				foldLocation(cs)
+			}
+		case *parsed.Let, *parsed.Record, *parsed.List:
+			foldLocation(e.Location())
+		}
+	})
+
+	imports, _ := scanImports(text)
+	for i := 0; i < len(imports); {
+		j := i
+		// imports separated by blank lines or comments still make one group
+		for j+1 < len(imports) && strings.TrimSpace(stripComments(text[imports[j].end:imports[j+1].moduleStart])) == "import" {
+			j++
+		}
+		fold(importStart(text, imports[i]), imports[j].end, protocol.Imports)
+		i = j + 1
+	}
+
+	for _, c := range commentBlocks(text) {
+		fold(c[0], c[1], protocol.Comment)
+	}
+
+	// clients keep a single range for a start line, the outermost one is the most useful
+	slices.SortStableFunc(result, func(a, b protocol.FoldingRange) int {
+		if a.StartLine != b.StartLine {
+			return int(a.StartLine) - int(b.StartLine)
+		}
+		return int(b.EndLine) - int(a.EndLine)
+	})
+	return slices.CompactFunc(result, func(a, b protocol.FoldingRange) bool { return a.StartLine == b.StartLine })
+}
+
+// selectionRanges returns ranges expanding from the identifier under the cursor to the enclosing
+// expressions, select case and definition
+func selectionRanges(loc ast.Location, m *parsed.Module) protocol.SelectionRange {
+	text := loc.FileContent()
+	locations := []ast.Location{m.Location()}
+	m.Iterate(func(stmt parsed.Statement) {
+		if stmt == nil || !stmt.Location().Contains(loc) {
+			return
+		}
+		locations = append(locations, trimLocation(stmt.Location()))
+		if sel, ok := stmt.(*parsed.Select); ok {
+			for _, cs := range selectCaseLocations(sel) {
+				if cs.Contains(loc) {
+					locations = append(locations, cs)
+				}
+			}
+		}
+	})
+	if start, end := identifierSegmentAt(text, int(loc.Start())); start < end {
+		locations = append(locations, ast.NewLocation(loc.FilePath(), text, uint32(start), uint32(end)))
+	}
+
+	slices.SortStableFunc(locations, func(a, b ast.Location) int { return int(b.Size()) - int(a.Size()) })
+	var result *protocol.SelectionRange
+	for _, l := range locations {
+		if result != nil && !containsLocation(result, l) {
+			continue
+		}
+		result = &protocol.SelectionRange{Range: locToRange(l), Parent: result}
+	}
+	if result == nil {
+		return protocol.SelectionRange{Range: locToRange(loc)}
+	}
+	return *result
+}
+
+// containsLocation checks that the parent range strictly contains location
+func containsLocation(parent *protocol.SelectionRange, loc ast.Location) bool {
+	r := locToRange(loc)
+	before := func(a, b protocol.Position) bool {
+		return a.Line < b.Line || (a.Line == b.Line && a.Character <= b.Character)
+	}
+	return before(parent.Range.Start, r.Start) && before(r.End, parent.Range.End) && r != parent.Range
+}
+
+// selectCaseLocations returns locations of select cases. Parsed cases do not expose their locations
+// so they are taken from the normalized select
+func selectCaseLocations(sel *parsed.Select) []ast.Location {
+	nSel, ok := sel.Successor().(*normalized.Select)
+	if !ok || nSel == nil {
+		return nil
+	}
+	return common.Map(func(cs *normalized.SelectCase) ast.Location {
+		return trimLocation(cs.Location())
+	}, nSel.Cases())
+}
+
+// trimLocation cuts trailing whitespace and comments that parsed locations include
+func trimLocation(loc ast.Location) ast.Location {
+	text := loc.FileContent()
+	end := int(loc.Start())
+	for i := int(loc.Start()); i < int(loc.End()); i++ {
+		switch {
+		case text[i] == '"' || text[i] == '\'':
+			quote := text[i]
+			for i++; i < int(loc.End()) && text[i] != quote; i++ {
+				if text[i] == '\\' {
+					i++
+				}
+			}
+			end = i + 1
+		case text[i] == '/' && i+1 < len(text) && text[i+1] == '/':
+			for i < int(loc.End()) && text[i] != '\n' {
+				i++
+			}
+		case text[i] == '/' && i+1 < len(text) && text[i+1] == '*':
+			for i += 2; i+1 < int(loc.End()) && !(text[i] == '*' && text[i+1] == '/'); i++ {
+			}
+			i++
+		case !unicode.IsSpace(text[i]):
+			end = i + 1
+		}
+	}
+	return ast.NewLocation(loc.FilePath(), text, loc.Start(), uint32(min(end, int(loc.End()))))
+}
+
+// importStart returns offset of the `import` keyword of the import statement
+func importStart(text []rune, imp importStatement) int {
+	pos := skipSpaceBack(text, imp.moduleStart) - len("import")
+	if pos < 0 {
+		return imp.moduleStart
+	}
+	return pos
+}
+
+// commentBlocks returns bounds of block comments and runs of consecutive line comments
+func commentBlocks(text []rune) [][2]int {
+	var result [][2]int
+	lineStart := -1
+	lineEnd := -1
+	flushLines := func() {
+		if lineStart >= 0 {
+			result = append(result, [2]int{lineStart, lineEnd})
+			lineStart = -1
+		}
+	}
+	pos := 0
+	for pos < len(text) {
+		end := pos
+		for end < len(text) && text[end] != '\n' {
+			end++
+		}
+		line := strings.TrimSpace(string(text[pos:end]))
+		switch {
+		case strings.HasPrefix(line, "//"):
+			if lineStart < 0 {
+				lineStart = pos
+			}
+			lineEnd = end
+		case strings.HasPrefix(line, "/*"):
+			flushLines()
+			if closing := strings.Index(string(text[pos:]), "*/"); closing >= 0 {
+				blockEnd := pos + len([]rune(string(text[pos:])[:closing])) + len("*/")
+				result = append(result, [2]int{pos, blockEnd})
+				end = blockEnd
+				for end < len(text) && text[end] != '\n' {
+					end++
+				}
+			}
+		default:
+			flushLines()
+		}
+		pos = end + 1
+	}
+	flushLines()
+	return result
+}
+
+// stripComments removes line comments from the text
+func stripComments(text []rune) string {
+	lines := strings.Split(string(text), "\n")
+	for i, line := range lines {
+		if idx := strings.Index(line, "//"); idx >= 0 {
+			lines[i] = line[:idx]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func skipSpaceBack(text []rune, pos int) int {
+	for pos > 0 && (text[pos-1] == ' ' || text[pos-1] == '\t' || text[pos-1] == '\n' || text[pos-1] == '\r') {
+		pos--
+	}
+	return pos
+}
+
+// lineAt returns zero based line number of the offset
+func lineAt(text []rune, offset int) uint32 {
+	var line uint32
+	for i := 0; i < offset && i < len(text); i++ {
+		if text[i] == '\n' {
+			line++
+		}
+	}
+	return line
+}
@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"github.com/nar-lang/nar-compiler/ast"
+	"slices"
+	"testing"
+)
+
+func TestTrimLocation(t *testing.T) {
+	tests := []struct {
+		name string
+		// text is the whole location, expected is the text of the trimmed location
+		text     string
+		expected string
+	}{
+		{name: "trailing spaces", text: "def a = 1  \n\n", expected: "def a = 1"},
+		{name: "line comment", text: "def a = 1 // one\n", expected: "def a = 1"},
+		{name: "block comment", text: "def a = 1 /* one\n two */\n", expected: "def a = 1"},
+		{name: "comment inside", text: "def a = /* one */ 1\n", expected: "def a = /* one */ 1"},
+		{name: "comment in string", text: "def a = \"// /*\" \n", expected: "def a = \"// /*\""},
+		{name: "escaped quote", text: "def a = \"\\\" //\" // a\n", expected: "def a = \"\\\" //\""},
+		{name: "quote in char", text: "def a = '\"' // a\n", expected: "def a = '\"'"},
+		{name: "only whitespace", text: "  \n", expected: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// location is surrounded with text that should not be taken into account
+			text := []rune("x\n" + tt.text + "def b = 2")
+			start := uint32(len("x\n"))
+			loc := ast.NewLocation("test.nar", text, start, start+uint32(len([]rune(tt.text))))
+			trimmed := trimLocation(loc)
+			if trimmed.Start() != loc.Start() {
+				t.Errorf("start moved from %d to %d", loc.Start(), trimmed.Start())
+			}
+			if actual := string(text[trimmed.Start():trimmed.End()]); actual != tt.expected {
+				t.Errorf("trimmed to %q, expected %q", actual, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCommentBlocks(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		expected []string
+	}{
+		{name: "no comments", text: "module A\n\ndef a = 1\n"},
+		{name: "line comment", text: "// one\ndef a = 1", expected: []string{"// one"}},
+		{
+			name:     "consecutive line comments",
+			text:     "def a = 1\n// one\n  // two\ndef b = 2",
+			expected: []string{"// one\n  // two"},
+		},
+		{
+			name:     "separated line comments",
+			text:     "// one\n\n// two\n",
+			expected: []string{"// one", "// two"},
+		},
+		{name: "trailing line comment is not a block", text: "def a = 1 // one\n"},
+		{name: "comment at the end", text: "def a = 1\n// one", expected: []string{"// one"}},
+		{
+			name:     "block comment",
+			text:     "/* one\n two */\ndef a = 1",
+			expected: []string{"/* one\n two */"},
+		},
+		{
+			name:     "line comments before block comment",
+			text:     "// one\n/* two\n */ def a = 1\n// three",
+			expected: []string{"// one", "/* two\n */", "// three"},
+		},
+		{name: "unterminated block comment", text: "/* one\ndef a = 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text := []rune(tt.text)
+			var actual []string
+			for _, block := range commentBlocks(text) {
+				actual = append(actual, string(text[block[0]:block[1]]))
+			}
+			if !slices.Equal(actual, tt.expected) {
+				t.Errorf("comment blocks are %q, expected %q", actual, tt.expected)
+			}
+		})
+	}
+}
@@ -13,15 +13,70 @@ import (
 
 func (s *server) locationUnderCursor(docURI protocol.DocumentURI, line, char uint32) (ast.Location, *parsed.Module, bool) {
 	path := uriToPath(docURI)
-	for _, m := range s.parsedModules {
-		if m != nil && m.Location().FilePath() == path {
-			loc := ast.NewLocationSrc(path, m.Location().FileContent(), line, char)
-			return loc, m, true
-		}
+	if m := s.moduleOfPath(path); m != nil {
+		loc := ast.NewLocationSrc(path, m.Location().FileContent(), line, char)
+		return loc, m, true
 	}
 	return ast.Location{}, nil, false
 }
 
+// offsetAt returns offset of the zero based line and column, unlike ast.NewLocationSrc
+// it resolves the position right after the last character of the text
+func offsetAt(text []rune, line, column uint32) int {
+	var l, c uint32
+	for i, r := range text {
+		if l == line && c == column {
+			return i
+		}
+		if r == '\n' {
+			if l == line {
+				return i
+			}
+			l++
+			c = 0
+		} else {
+			c++
+		}
+	}
+	return len(text)
+}
+
+// moduleOfPath returns currently loaded module by its file path
+func (s *server) moduleOfPath(path string) *parsed.Module {
+	if name, ok := s.index.paths[path]; ok {
+		if m, ok := s.parsedModules[name]; ok && m != nil && m.Location().FilePath() == path {
+			return m
+		}
+	}
+	return nil
+}
+
+// withDependents returns given modules and all modules that import them directly or through other modules
+func withDependents(
+	modules map[ast.QualifiedIdentifier]*parsed.Module, names []ast.QualifiedIdentifier,
+) map[ast.QualifiedIdentifier]struct{} {
+	result := map[ast.QualifiedIdentifier]struct{}{}
+	for _, name := range names {
+		result[name] = struct{}{}
+	}
+	for grown := true; grown; {
+		grown = false
+		for name, m := range modules {
+			if _, ok := result[name]; ok {
+				continue
+			}
+			for _, imp := range m.Imports() {
+				if _, ok := result[imp.Module()]; ok {
+					result[name] = struct{}{}
+					grown = true
+					break
+				}
+			}
+		}
+	}
+	return result
+}
+
 func (s *server) statementAtLocation(
 	loc ast.Location, m *parsed.Module,
 ) (
@@ -75,13 +130,7 @@ func (s *server) setDocumentStatus(uri protocol.DocumentURI, opened bool) {
 		}
 	}
 
-	var providers []locator.Provider
-	for _, p := range s.provides {
-		providers = append(providers, p)
-	}
-	providers = append(providers, s.workspaceProviders...)
-	providers = append(providers, s.cacheProvider)
-	s.locator = locator.NewLocator(providers...)
+	s.updateLocator()
 
 	for pkgRoot := range s.packageRootToName {
 		delete(s.packageRootToName, pkgRoot)
@@ -99,6 +148,17 @@ func (s *server) setDocumentStatus(uri protocol.DocumentURI, opened bool) {
 	s.locker.Unlock()
 }
 
+// updateLocator rebuilds the locator from package and workspace providers, the caller holds the lock
+func (s *server) updateLocator() {
+	var providers []locator.Provider
+	for _, p := range s.provides {
+		providers = append(providers, p)
+	}
+	providers = append(providers, s.workspaceProviders...)
+	providers = append(providers, s.cacheProvider)
+	s.locator = locator.NewLocator(providers...)
+}
+
 func (s *server) getProvider(textDocumentUrl protocol.DocumentURI) (*provider, bool) {
 	p, ok := s.provides[s.documentToPackageRoot[textDocumentUrl]]
 	return p, ok
@@ -113,3 +173,13 @@ func findPackageRoot(path string) string {
 	}
 	return ""
 }
+
+// documentText returns current content of the document including changes that are not compiled yet
+func (s *server) documentText(uri protocol.DocumentURI, m *parsed.Module) []rune {
+	if pvd, ok := s.getProvider(uri); ok {
+		if text, ok := pvd.overrides[uriToPath(uri)]; ok {
+			return text
+		}
+	}
+	return m.Location().FileContent()
+}
@@ -0,0 +1,221 @@
+package internal
+
+import (
+	"fmt"
+	"github.com/nar-lang/nar-compiler"
+	"github.com/nar-lang/nar-compiler/ast"
+	"github.com/nar-lang/nar-compiler/ast/parsed"
+	"github.com/nar-lang/nar-compiler/ast/typed"
+	"github.com/nar-lang/nar-compiler/compiler"
+	"github.com/nar-lang/nar-compiler/locator"
+	"github.com/nar-lang/nar-compiler/logger"
+	"github.com/nar/internal/protocol"
+	"maps"
+	"strings"
+	"unicode"
+)
+
+// Typed holes are `_` placed in expression position. The parser does not accept them, so for a separate
+// diagnostic compilation every hole is replaced with a reference to polymorphic native definition appended
+// to the end of the module. The name is one letter long to keep all source locations in place,
+// and type checker infers the type expected at each hole independently.
+const holeName = "ɂ"
+
+var holeDefinition = fmt.Sprintf("\n%s %s %s %s: a\n", nar_compiler.KwDef, nar_compiler.KwHidden, nar_compiler.KwNative, holeName)
+
+// fillHoles returns source text with typed holes replaced or the text itself if there are no holes
+func fillHoles(text []rune) []rune {
+	const (
+		inExpression = iota
+		inDeclaration
+		inCasePattern
+		inLetPattern
+		inLambdaParams
+	)
+
+	var filled []rune
+	mode := inDeclaration
+	modeDepth := 0
+	depth := 0
+	isInfixChar := func(i int) bool {
+		return i >= 0 && i < len(text) && strings.ContainsRune(nar_compiler.SeqInfixChars, text[i])
+	}
+	isKeyword := func(i int, kw string) bool {
+		end := i + len(kw)
+		return end <= len(text) && string(text[i:end]) == kw &&
+			(i == 0 || !isIdentChar(text[i-1])) && (end == len(text) || !isIdentChar(text[end]))
+	}
+
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == '/' && i+1 < len(text) && text[i+1] == '/':
+			for i < len(text) && text[i] != '\n' {
+				i++
+			}
+			i--
+		case c == '/' && i+1 < len(text) && text[i+1] == '*':
+			for i+1 < len(text) && !(text[i] == '*' && text[i+1] == '/') {
+				i++
+			}
+			i++
+		case c == '"' || c == '\'':
+			for i++; i < len(text) && text[i] != c && text[i] != '\n'; i++ {
+				if text[i] == '\\' {
+					i++
+				}
+			}
+		case c == '(' || c == '[' || c == '{':
+			if c == '(' && i > 0 && text[i-1] == '\\' && mode == inExpression {
+				mode = inLambdaParams
+				modeDepth = depth
+			}
+			depth++
+		case c == ')' || c == ']' || c == '}':
+			depth--
+			if mode == inLambdaParams && depth == modeDepth {
+				mode = inExpression
+			}
+		case c == '\n':
+			if i+1 < len(text) && !unicode.IsSpace(text[i+1]) {
+				mode = inDeclaration
+				depth = 0
+			}
+		case c == '-' && i+1 < len(text) && text[i+1] == '>':
+			if mode == inCasePattern && depth == modeDepth {
+				mode = inExpression
+			}
+			i++
+		case c == '=' && !isInfixChar(i-1) && !isInfixChar(i+1):
+			if (mode == inDeclaration && depth == 0) || (mode == inLetPattern && depth == modeDepth) {
+				mode = inExpression
+			}
+		case mode == inExpression && isKeyword(i, nar_compiler.KwCase):
+			mode = inCasePattern
+			modeDepth = depth
+		case mode == inExpression && isKeyword(i, nar_compiler.KwLet):
+			mode = inLetPattern
+			modeDepth = depth
+		case c == '_' && mode == inExpression &&
+			(i == 0 || !isIdentChar(text[i-1])) && (i+1 == len(text) || !isIdentChar(text[i+1])):
+			if filled == nil {
+				filled = make([]rune, len(text), len(text)+len(holeDefinition))
+				copy(filled, text)
+			}
+			filled[i] = []rune(holeName)[0]
+		}
+	}
+
+	if filled == nil {
+		return text
+	}
+	return append(filled, []rune(holeDefinition)...)
+}
+
+// holeDiagnostics compiles packages of opened documents once more with typed holes filled and reports
+// the type inferred at each hole along with other errors of that compilation. Filled sources go to
+// copies of module maps, so modules used by other features always match documents of the client.
+// Returns nil if there are no holes.
+func (s *server) holeDiagnostics() map[protocol.DocumentURI][]protocol.Diagnostic {
+	s.locker.Lock()
+	filled := map[string]struct{}{}
+	var providers []locator.Provider
+	for _, pvd := range s.provides {
+		providers = append(providers, holesProvider{provider: pvd, filled: filled})
+	}
+	providers = append(providers, s.workspaceProviders...)
+	providers = append(providers, s.cacheProvider)
+	s.locker.Unlock()
+
+	lc := locator.NewLocator(providers...)
+	if _, err := lc.Packages(); err != nil || len(filled) == 0 {
+		return nil
+	}
+
+	s.locker.Lock()
+	// modules with holes were compiled from sources with syntax errors, they and their dependents
+	// are compiled again from scratch to keep successors of the server modules untouched
+	var filledNames []ast.QualifiedIdentifier
+	for name, m := range s.parsedModules {
+		if _, ok := filled[m.Location().FilePath()]; ok {
+			filledNames = append(filledNames, name)
+		}
+	}
+	parsedModules := maps.Clone(s.parsedModules)
+	normalizedModules := maps.Clone(s.normalizedModules)
+	typedModules := maps.Clone(s.typedModules)
+	for name := range withDependents(s.parsedModules, filledNames) {
+		delete(parsedModules, name)
+		delete(normalizedModules, name)
+		delete(typedModules, name)
+	}
+	s.locker.Unlock()
+
+	log := &logger.LogWriter{}
+	_, affectedModuleNames := compiler.CompileEx(log, lc, nil, true, parsedModules, normalizedModules, typedModules)
+
+	diagnosticData := s.extractDiagnosticsData(log)
+	for _, m := range parsedModules {
+		if _, ok := filled[m.Location().FilePath()]; !ok {
+			continue
+		}
+		uri := pathToUri(m.Location().FilePath())
+		m.Iterate(func(stmt parsed.Statement) {
+			nStmt := stmt.Successor()
+			if nStmt == nil {
+				return
+			}
+			if g, ok := nStmt.Successor().(*typed.Global); ok && g.Definition() != nil && g.Definition().Name() == holeName {
+				message := "found hole"
+				if g.Type() != nil {
+					message = fmt.Sprintf("found hole of type `%s`", g.Type().Code(m.Name()))
+				}
+				diagnosticData[uri] = append(diagnosticData[uri], protocol.Diagnostic{
+					Range:    locToRange(g.Location()),
+					Severity: protocol.SeverityError,
+					Message:  message,
+				})
+			}
+		})
+	}
+	for _, name := range affectedModuleNames {
+		uri := pathToUri(parsedModules[name].Location().FilePath())
+		if _, reported := diagnosticData[uri]; !reported {
+			diagnosticData[uri] = []protocol.Diagnostic{}
+		}
+	}
+	return diagnosticData
+}
+
+// holesProvider gives packages of the provider with typed holes filled and collects paths of filled sources
+type holesProvider struct {
+	provider *provider
+	filled   map[string]struct{}
+}
+
+func (h holesProvider) ExportedPackages() ([]locator.Package, error) {
+	packages, err := h.provider.ExportedPackages()
+	if err != nil {
+		return nil, err
+	}
+	return []locator.Package{h.fill(packages[0])}, nil
+}
+
+func (h holesProvider) LoadPackage(name string) (locator.Package, bool, error) {
+	pkg, ok, err := h.provider.LoadPackage(name)
+	if !ok || err != nil {
+		return pkg, ok, err
+	}
+	return h.fill(pkg), true, nil
+}
+
+func (h holesProvider) fill(pkg locator.Package) locator.Package {
+	sources := map[string][]rune{}
+	for path, text := range pkg.Sources() {
+		sources[path] = fillHoles(text)
+		if len(sources[path]) != len(text) {
+			h.filled[path] = struct{}{}
+		}
+	}
+	return locator.NewLoadedPackage(pkg.Info(), sources, pkg.Path())
+}
@@ -0,0 +1,199 @@
+package internal
+
+import (
+	"github.com/nar-lang/nar-compiler/ast"
+	"github.com/nar-lang/nar-compiler/ast/parsed"
+	"github.com/nar-lang/nar-compiler/ast/typed"
+	"github.com/nar-lang/nar-compiler/common"
+	"strings"
+)
+
+func (s *server) hoverText(stmt typed.Statement, currentModule ast.QualifiedIdentifier) string {
+	switch e := stmt.(type) {
+	case *typed.Global:
+		if def := e.Definition(); def != nil {
+			return s.describeDefinition(def, currentModule)
+		}
+		return markdownCode(e.Code("") + typeSuffix(e.Type(), currentModule))
+	case *typed.Definition:
+		return s.describeDefinition(e, currentModule)
+	case *typed.Local:
+		return markdownCode(e.Code(currentModule) + typeSuffix(e.Type(), currentModule))
+	case typed.Pattern:
+		code := e.Code(currentModule)
+		if e.DeclaredType() == nil {
+			code += typeSuffix(e.Type(), currentModule)
+		}
+		return markdownCode(code)
+	case typed.Type:
+		return markdownCode(e.Code(""))
+	case typed.Expression:
+		if e.Type() != nil {
+			return markdownCode(e.Type().Code(currentModule))
+		}
+	}
+	return ""
+}
+
+func (s *server) describeDefinition(def *typed.Definition, currentModule ast.QualifiedIdentifier) string {
+	mod := s.moduleOfLocation(def.Location())
+	if mod == nil {
+		return markdownCode(definitionSignature(def, "", nil, currentModule))
+	}
+
+	var pDef parsed.Definition
+	if d, ok := common.Find(func(d parsed.Definition) bool { return d.Name() == def.Name() }, mod.Definitions()); ok {
+		pDef = d
+	}
+
+	sb := strings.Builder{}
+	sb.WriteString(markdownCode(definitionSignature(def, mod.Name(), pDef, currentModule)))
+	if c, ok := def.Body().(*typed.Constructor); ok {
+		sb.WriteString("\n\noption of `")
+		sb.WriteString(string(c.DataName()))
+		sb.WriteString("`")
+	}
+	if doc := docComment(def.Location()); doc != "" {
+		sb.WriteString("\n\n---\n\n")
+		sb.WriteString(doc)
+	}
+	sb.WriteString("\n\n---\n\ndefined in `")
+	sb.WriteString(string(mod.Name()))
+	sb.WriteString("`")
+	if mod.PackageName() != "" {
+		sb.WriteString(" (package `")
+		sb.WriteString(string(mod.PackageName()))
+		sb.WriteString("`)")
+	}
+	return sb.String()
+}
+
+// definitionSignature returns declaration of the definition with fully qualified name and
+// declared or inferred types of parameters and returned value. Data type options are formatted as constructors.
+func definitionSignature(
+	def *typed.Definition, moduleName ast.QualifiedIdentifier, pDef parsed.Definition,
+	currentModule ast.QualifiedIdentifier,
+) string {
+	label, _ := definitionSignatureParts(def, moduleName, pDef, currentModule)
+	return label
+}
+
+// definitionSignatureParts returns signature of the definition and labels of its parameters as they appear in it
+func definitionSignatureParts(
+	def *typed.Definition, moduleName ast.QualifiedIdentifier, pDef parsed.Definition,
+	currentModule ast.QualifiedIdentifier,
+) (string, []string) {
+	sb := strings.Builder{}
+	_, isConstructor := def.Body().(*typed.Constructor)
+	if !isConstructor {
+		sb.WriteString("def ")
+		if pDef != nil && pDef.Hidden() {
+			sb.WriteString("hidden ")
+		}
+		if _, ok := def.Body().(*typed.Call); ok {
+			sb.WriteString("native ")
+		}
+	}
+	if moduleName != "" {
+		sb.WriteString(string(common.MakeFullIdentifier(moduleName, def.Name())))
+	} else {
+		sb.WriteString(string(def.Name()))
+	}
+	var params []string
+	if len(def.Params()) > 0 {
+		sb.WriteString("(")
+		for i, p := range def.Params() {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			param := patternSignature(p, currentModule)
+			if isConstructor && p.Type() != nil {
+				param = p.Type().Code(currentModule)
+			}
+			params = append(params, param)
+			sb.WriteString(param)
+		}
+		sb.WriteString(")")
+	}
+	sb.WriteString(typeSuffix(definitionReturnType(def), currentModule))
+	return sb.String(), params
+}
+
+func patternSignature(p typed.Pattern, currentModule ast.QualifiedIdentifier) string {
+	if p.DeclaredType() != nil {
+		return p.Code(currentModule)
+	}
+	return p.Code(currentModule) + typeSuffix(p.Type(), currentModule)
+}
+
+func definitionReturnType(def *typed.Definition) typed.Type {
+	if fn, ok := def.DeclaredType().(*typed.TFunc); ok && len(def.Params()) > 0 && fn.Return() != nil {
+		return fn.Return()
+	}
+	if def.DeclaredType() != nil && len(def.Params()) == 0 {
+		return def.DeclaredType()
+	}
+	if def.Body() != nil {
+		return def.Body().Type()
+	}
+	return nil
+}
+
+func typeSuffix(t typed.Type, currentModule ast.QualifiedIdentifier) string {
+	if t == nil {
+		return ""
+	}
+	return ": " + t.Code(currentModule)
+}
+
+func markdownCode(code string) string {
+	return "```nar\n" + code + "\n```"
+}
+
+// docComment returns text of the comment lines (or comment block) right above the statement
+func docComment(loc ast.Location) string {
+	text := loc.FileContent()
+	if int(loc.Start()) > len(text) {
+		return ""
+	}
+	lines := strings.Split(string(text[:loc.Start()]), "\n")
+	lines = lines[:len(lines)-1]
+
+	var doc []string
+	inBlock := false
+	for i := len(lines) - 1; i >= 0; i-- {
+		line := strings.TrimSpace(lines[i])
+		if inBlock {
+			if strings.HasPrefix(line, "/*") {
+				doc = append(doc, strings.TrimSpace(strings.TrimPrefix(line, "/*")))
+				break
+			}
+			doc = append(doc, strings.TrimSpace(strings.TrimPrefix(line, "*")))
+			continue
+		}
+		if strings.HasPrefix(line, "//") {
+			doc = append(doc, strings.TrimSpace(strings.TrimPrefix(line, "//")))
+			continue
+		}
+		if len(doc) == 0 && strings.HasSuffix(line, "*/") {
+			line = strings.TrimSpace(strings.TrimSuffix(line, "*/"))
+			if strings.HasPrefix(line, "/*") {
+				doc = append(doc, strings.TrimSpace(strings.TrimPrefix(line, "/*")))
+				break
+			}
+			doc = append(doc, line)
+			inBlock = true
+			continue
+		}
+		break
+	}
+
+	for i, j := 0, len(doc)-1; i < j; i, j = i+1, j-1 {
+		doc[i], doc[j] = doc[j], doc[i]
+	}
+	return strings.TrimSpace(strings.Join(doc, "\n"))
+}
+
+func (s *server) moduleOfLocation(loc ast.Location) *parsed.Module {
+	return s.moduleOfPath(loc.FilePath())
+}
@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"fmt"
+	"github.com/nar-lang/nar-compiler/ast"
+	"github.com/nar/internal/protocol"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// importStatement is an import found in the source text. Parsed imports do not expose
+// their locations and exposing lists, so they are scanned from the text directly.
+type importStatement struct {
+	module      ast.QualifiedIdentifier
+	moduleStart int // offset of the module name
+	alias       ast.Identifier
+	exposingAll bool
+	exposing    []string
+	listStart   int // offset of `(` opening exposing list or -1 if there is no list
+	listEnd     int // offset of `)` closing exposing list or -1 if there is no list
+	end         int // offset right after the last token of the import
+}
+
+func (imp importStatement) exposes(name ast.Identifier) bool {
+	return imp.exposingAll || slices.Contains(imp.exposing, string(name))
+}
+
+// scanImports returns imports of the module and the offset where a new import can be inserted
+func scanImports(text []rune) ([]importStatement, int) {
+	var imports []importStatement
+	insertAt := -1
+	pos := 0
+	for pos < len(text) {
+		lineEnd := pos
+		for lineEnd < len(text) && text[lineEnd] != '\n' {
+			lineEnd++
+		}
+		line := strings.TrimSpace(string(text[pos:lineEnd]))
+		switch {
+		case strings.HasPrefix(line, "module "):
+			insertAt = lineEnd
+		case strings.HasPrefix(line, "import "):
+			imp := scanImport(text, pos)
+			imports = append(imports, imp)
+			insertAt = imp.end
+			lineEnd = imp.end
+			for lineEnd < len(text) && text[lineEnd] != '\n' {
+				lineEnd++
+			}
+		case line == "", strings.HasPrefix(line, "//"):
+		default:
+			if insertAt >= 0 {
+				return imports, insertAt
+			}
+		}
+		pos = lineEnd + 1
+	}
+	if insertAt < 0 {
+		insertAt = 0
+	}
+	return imports, insertAt
+}
+
+func scanImport(text []rune, pos int) importStatement {
+	imp := importStatement{listStart: -1, listEnd: -1}
+	readWord := func() string {
+		for pos < len(text) && unicode.IsSpace(text[pos]) {
+			pos++
+		}
+		start := pos
+		for pos < len(text) && isIdentChar(text[pos]) {
+			pos++
+		}
+		return string(text[start:pos])
+	}
+	skipSpace := func() {
+		for pos < len(text) && text[pos] != '\n' && unicode.IsSpace(text[pos]) {
+			pos++
+		}
+	}
+
+	readWord() // import
+	imp.module = ast.QualifiedIdentifier(readWord())
+	imp.moduleStart = pos - len([]rune(imp.module))
+	imp.end = pos
+	skipSpace()
+	if strings.HasPrefix(string(text[pos:]), "as ") {
+		readWord()
+		imp.alias = ast.Identifier(readWord())
+		imp.end = pos
+		skipSpace()
+	}
+	if !strings.HasPrefix(string(text[pos:]), "exposing") {
+		return imp
+	}
+	pos += len("exposing")
+	for pos < len(text) && unicode.IsSpace(text[pos]) {
+		pos++
+	}
+	if pos < len(text) && text[pos] == '*' {
+		imp.exposingAll = true
+		imp.end = pos + 1
+		return imp
+	}
+	if pos >= len(text) || text[pos] != '(' {
+		return imp
+	}
+	close := pos
+	for close < len(text) && text[close] != ')' {
+		close++
+	}
+	for _, name := range strings.Split(string(text[pos+1:min(close, len(text))]), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			imp.exposing = append(imp.exposing, name)
+		}
+	}
+	if close < len(text) {
+		imp.listStart = pos
+		imp.listEnd = close
+		imp.end = close + 1
+	}
+	return imp
+}
+
+// importEdit returns edit that makes name of the module visible without qualifier
+// by extending existing import or adding a new one
+func importEdit(
+	path string, text []rune, module ast.QualifiedIdentifier, name ast.Identifier,
+) (protocol.TextEdit, bool) {
+	imports, insertAt := scanImports(text)
+	for _, imp := range imports {
+		if imp.module != module {
+			continue
+		}
+		if imp.exposes(name) {
+			return protocol.TextEdit{}, false
+		}
+		if imp.listEnd >= 0 {
+			if len(imp.exposing) == 0 {
+				return insertTextEdit(path, text, imp.listEnd, string(name)), true
+			}
+			return insertTextEdit(path, text, imp.listEnd, ", "+string(name)), true
+		}
+		return insertTextEdit(path, text, imp.end, fmt.Sprintf(" exposing (%s)", name)), true
+	}
+
+	newImport := fmt.Sprintf("import %s exposing (%s)", module, name)
+	if len(imports) == 0 {
+		return insertTextEdit(path, text, insertAt, "\n\n"+newImport), true
+	}
+	return insertTextEdit(path, text, insertAt, "\n"+newImport), true
+}
+
+func insertTextEdit(path string, text []rune, offset int, newText string) protocol.TextEdit {
+	r := locToRange(ast.NewLocation(path, text, uint32(offset), uint32(offset)))
+	return protocol.TextEdit{Range: r, NewText: newText}
+}
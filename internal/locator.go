@@ -22,6 +22,7 @@ type provider struct {
 	merged     map[string][]rune
 	path       string
 	pkg        locator.Package
+	stale      bool
 }
 
 func (p *provider) ExportedPackages() ([]locator.Package, error) {
@@ -42,6 +43,11 @@ func (p *provider) LoadPackage(name string) (locator.Package, bool, error) {
 }
 
 func (p *provider) load() error {
+	if p.stale {
+		// file system provider caches package info and sources, changes on disk require a new one
+		p.fsProvider = locator.NewFileSystemPackageProvider(p.path)
+		p.stale = false
+	}
 	pkg, err := p.fsProvider.ExportedPackages()
 	if err != nil {
 		return err
@@ -68,3 +74,8 @@ func (p *provider) OverrideFile(uri protocol.DocumentURI, content []rune) {
 		p.overrides[path] = content
 	}
 }
+
+// Invalidate makes provider to reload the package from disk on the next load
+func (p *provider) Invalidate() {
+	p.stale = true
+}
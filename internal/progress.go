@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/nar/internal/protocol"
+	"strings"
+)
+
+// progress reports work done progress to the client, it does nothing if the client does not support progress
+type progress struct {
+	s     *server
+	token protocol.ProgressToken
+}
+
+// beginProgress starts progress with the token sent by the client or creates a new one.
+// Progress can be reported with a created token only after the client accepted it, so it waits for the response.
+func (s *server) beginProgress(token protocol.ProgressToken, title string) *progress {
+	if token == nil {
+		if !s.progressSupport {
+			return &progress{s: s}
+		}
+		token = fmt.Sprintf("nar/%d", s.lastRequestId.Add(1))
+		if _, ok := s.requestAndWait(
+			"window/workDoneProgress/create", protocol.WorkDoneProgressCreateParams{Token: token},
+		); !ok {
+			return &progress{s: s}
+		}
+	}
+	s.notify("$/progress", protocol.ProgressParams{
+		Token: token,
+		Value: protocol.WorkDoneProgressBegin{Kind: "begin", Title: title},
+	})
+	return &progress{s: s, token: token}
+}
+
+func (p *progress) report(message string) {
+	if p.token != nil {
+		p.s.notify("$/progress", protocol.ProgressParams{
+			Token: p.token,
+			Value: protocol.WorkDoneProgressReport{Kind: "report", Message: message},
+		})
+	}
+}
+
+func (p *progress) reportPercentage(message string, percentage uint32) {
+	if p.token != nil {
+		p.s.notify("$/progress", protocol.ProgressParams{
+			Token: p.token,
+			Value: protocol.WorkDoneProgressReport{Kind: "report", Message: message, Percentage: percentage},
+		})
+	}
+}
+
+func (p *progress) end(message string) {
+	if p.token != nil {
+		p.s.notify("$/progress", protocol.ProgressParams{
+			Token: p.token,
+			Value: protocol.WorkDoneProgressEnd{Kind: "end", Message: message},
+		})
+	}
+}
+
+// logMessageWriter sends written lines to the client as window/logMessage notifications
+type logMessageWriter struct {
+	s       *server
+	type_   protocol.MessageType
+	pending []byte
+}
+
+func (w *logMessageWriter) Write(data []byte) (int, error) {
+	w.pending = append(w.pending, data...)
+	for {
+		i := bytes.IndexByte(w.pending, '\n')
+		if i < 0 {
+			break
+		}
+		w.s.logMessage(w.type_, string(w.pending[:i]))
+		w.pending = w.pending[i+1:]
+	}
+	return len(data), nil
+}
+
+// Flush sends the last line if it is not terminated with a new line
+func (w *logMessageWriter) Flush() {
+	if len(w.pending) > 0 {
+		w.s.logMessage(w.type_, string(w.pending))
+		w.pending = nil
+	}
+}
+
+func (s *server) logMessage(type_ protocol.MessageType, message string) {
+	s.notify("window/logMessage", protocol.LogMessageParams{
+		Type:    type_,
+		Message: strings.TrimRight(message, "\r"),
+	})
+}
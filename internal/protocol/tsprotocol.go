@@ -2752,7 +2752,7 @@ type OptionalVersionedTextDocumentIdentifier struct {
 	// (the server has not received an open notification before) the server can send
 	// `null` to indicate that the version is unknown and the content on disk is the
 	// truth (as specified with document content ownership).
-	Version int32 `json:"version"`
+	Version *int32 `json:"version"`
 	TextDocumentIdentifier
 }
 
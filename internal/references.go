@@ -0,0 +1,327 @@
+package internal
+
+import (
+	"github.com/nar-lang/nar-compiler/ast"
+	"github.com/nar-lang/nar-compiler/ast/parsed"
+	"github.com/nar-lang/nar-compiler/ast/typed"
+	"github.com/nar-lang/nar-compiler/common"
+	"github.com/nar/internal/protocol"
+	"maps"
+	"strings"
+)
+
+// definitionUse is a place where a global definition or a type is referenced
+type definitionUse struct {
+	location ast.Location            // location of the referencing expression, pattern or type
+	caller   ast.FullIdentifier      // top level definition containing the reference, empty for type aliases
+	module   ast.QualifiedIdentifier // module containing the reference
+}
+
+// referenceIndex maps global definitions and types to places they are used at and file paths to modules.
+// It is updated after each compilation only for affected modules. Updates are made on a copy
+// that replaces the index as a whole, so requests always see consistent state.
+type referenceIndex struct {
+	uses     map[ast.FullIdentifier][]definitionUse
+	typeUses map[ast.FullIdentifier][]definitionUse
+	modules  map[ast.QualifiedIdentifier]indexedModule
+	paths    map[string]ast.QualifiedIdentifier
+}
+
+// indexedModule lists keys of index entries made for the module to drop them when the module is recompiled
+type indexedModule struct {
+	path       string
+	references []ast.FullIdentifier
+	types      []ast.FullIdentifier
+}
+
+func newReferenceIndex() *referenceIndex {
+	return &referenceIndex{
+		uses:     map[ast.FullIdentifier][]definitionUse{},
+		typeUses: map[ast.FullIdentifier][]definitionUse{},
+		modules:  map[ast.QualifiedIdentifier]indexedModule{},
+		paths:    map[string]ast.QualifiedIdentifier{},
+	}
+}
+
+// updateReferenceIndex reindexes given modules and drops modules that are not loaded anymore
+func (s *server) updateReferenceIndex(moduleNames []ast.QualifiedIdentifier) {
+	idx := &referenceIndex{
+		uses:     maps.Clone(s.index.uses),
+		typeUses: maps.Clone(s.index.typeUses),
+		modules:  maps.Clone(s.index.modules),
+		paths:    maps.Clone(s.index.paths),
+	}
+	for name := range idx.modules {
+		if m, ok := s.parsedModules[name]; !ok || m == nil {
+			idx.remove(name)
+		}
+	}
+	for _, name := range moduleNames {
+		idx.remove(name)
+	}
+	for _, name := range moduleNames {
+		if m, ok := s.parsedModules[name]; ok && m != nil {
+			idx.paths[m.Location().FilePath()] = name
+		}
+	}
+	for _, name := range moduleNames {
+		if m, ok := s.parsedModules[name]; ok && m != nil {
+			idx.add(m)
+		}
+	}
+	s.index = idx
+}
+
+func (idx *referenceIndex) remove(name ast.QualifiedIdentifier) {
+	indexed, ok := idx.modules[name]
+	if !ok {
+		return
+	}
+	notFromModule := func(use definitionUse) bool { return use.module != name }
+	for _, id := range indexed.references {
+		idx.uses[id] = common.Filter(notFromModule, idx.uses[id])
+		if len(idx.uses[id]) == 0 {
+			delete(idx.uses, id)
+		}
+	}
+	for _, id := range indexed.types {
+		idx.typeUses[id] = common.Filter(notFromModule, idx.typeUses[id])
+		if len(idx.typeUses[id]) == 0 {
+			delete(idx.typeUses, id)
+		}
+	}
+	if idx.paths[indexed.path] == name {
+		delete(idx.paths, indexed.path)
+	}
+	delete(idx.modules, name)
+}
+
+func (idx *referenceIndex) add(m *parsed.Module) {
+	indexed := indexedModule{path: m.Location().FilePath()}
+	for _, def := range m.Definitions() {
+		caller := common.MakeFullIdentifier(m.Name(), def.Name())
+		forEachGlobalReference(def, func(loc ast.Location, target *typed.Definition) {
+			if id, ok := idx.definitionIdentifier(target); ok {
+				idx.uses[id] = append(idx.uses[id], definitionUse{location: loc, caller: caller, module: m.Name()})
+				indexed.references = append(indexed.references, id)
+			}
+		})
+	}
+	// the same type annotation may be shared by several statements (e.g. data type and its alias)
+	seenTypes := map[uint32]struct{}{}
+	m.Iterate(func(stmt parsed.Statement) {
+		if stmt == nil || stmt.Successor() == nil {
+			return
+		}
+		if _, seen := seenTypes[stmt.Location().Start()]; seen {
+			return
+		}
+		var id ast.FullIdentifier
+		switch t := stmt.Successor().Successor().(type) {
+		case *typed.TData:
+			id = t.Name()
+		case *typed.TNative:
+			id = t.Name()
+		default:
+			return
+		}
+		seenTypes[stmt.Location().Start()] = struct{}{}
+		idx.typeUses[id] = append(idx.typeUses[id], definitionUse{location: stmt.Location(), module: m.Name()})
+		indexed.types = append(indexed.types, id)
+	})
+	idx.modules[m.Name()] = indexed
+}
+
+// definitionIdentifier returns full identifier of the typed definition
+func (idx *referenceIndex) definitionIdentifier(def *typed.Definition) (ast.FullIdentifier, bool) {
+	if name, ok := idx.paths[def.Location().FilePath()]; ok {
+		return common.MakeFullIdentifier(name, def.Name()), true
+	}
+	return "", false
+}
+
+// moduleUses returns uses of all definitions and types of the module
+func (idx *referenceIndex) moduleUses(name ast.QualifiedIdentifier) []definitionUse {
+	var uses []definitionUse
+	for _, m := range []map[ast.FullIdentifier][]definitionUse{idx.uses, idx.typeUses} {
+		for id, xs := range m {
+			if strings.HasPrefix(string(id), string(name)+".") && !strings.Contains(string(id)[len(name)+1:], ".") {
+				uses = append(uses, xs...)
+			}
+		}
+	}
+	return uses
+}
+
+// forEachGlobalReference calls f for each reference to a global definition (or data option) inside the definition
+func forEachGlobalReference(def parsed.Definition, f func(loc ast.Location, target *typed.Definition)) {
+	def.Iterate(func(stmt parsed.Statement) {
+		if stmt == nil {
+			return
+		}
+		nStmt := stmt.Successor()
+		if nStmt == nil {
+			return
+		}
+		var target *typed.Definition
+		switch e := nStmt.Successor().(type) {
+		case *typed.Global:
+			target = e.Definition()
+		case *typed.POption:
+			target = e.Definition()
+		}
+		if target != nil {
+			f(stmt.Location(), target)
+		}
+	})
+}
+
+// definitionIdentifier returns full identifier of the typed definition
+func (s *server) definitionIdentifier(def *typed.Definition) (ast.FullIdentifier, bool) {
+	return s.index.definitionIdentifier(def)
+}
+
+// occurrence is a declaration or a use of the symbol
+type occurrence struct {
+	location    ast.Location
+	declaration bool
+}
+
+// occurrences returns name of the definition, local pattern or type under the cursor
+// with its declaration (if it is known) and all its uses
+func (s *server) occurrences(loc ast.Location, m *parsed.Module) (ast.Identifier, []occurrence) {
+	var result []occurrence
+	appendUses := func(declaration ast.Location, uses []definitionUse) {
+		result = append(result, occurrence{location: declaration, declaration: true})
+		for _, use := range uses {
+			result = append(result, occurrence{location: use.location})
+		}
+	}
+	appendDefinition := func(def *typed.Definition) ast.Identifier {
+		if def == nil {
+			return ""
+		}
+		if id, ok := s.definitionIdentifier(def); ok {
+			appendUses(def.NameLocation(), s.index.uses[id])
+		}
+		return def.Name()
+	}
+	appendType := func(id ast.FullIdentifier) ast.Identifier {
+		name := ast.Identifier(id[strings.LastIndex(string(id), ".")+1:])
+		if decl, ok := s.typeDeclaration(id); ok {
+			result = append(result, occurrence{location: decl, declaration: true})
+		}
+		for _, use := range s.index.typeUses[id] {
+			result = append(result, occurrence{location: use.location})
+		}
+		return name
+	}
+
+	text := loc.FileContent()
+	start, end := identifierSegmentAt(text, int(loc.Start()))
+	word := ast.Identifier(text[start:end])
+
+	_, _, stmt := s.statementAtLocation(loc, m)
+	switch e := stmt.(type) {
+	case *typed.Global:
+		return appendDefinition(e.Definition()), result
+	case *typed.POption:
+		return appendDefinition(e.Definition()), result
+	case *typed.Definition:
+		return appendDefinition(e), result
+	case *typed.Local:
+		if e.Target() != nil {
+			appendUses(e.Target().Location(), localUses(m, e.Target()))
+		}
+		return word, result
+	case *typed.TData:
+		return appendType(e.Name()), result
+	case *typed.TNative:
+		return appendType(e.Name()), result
+	case typed.Pattern:
+		appendUses(e.Location(), localUses(m, e))
+		return word, result
+	}
+	return "", nil
+}
+
+// typeDeclaration returns location of the name in declaration of data type or type alias
+func (s *server) typeDeclaration(id ast.FullIdentifier) (ast.Location, bool) {
+	lastDot := strings.LastIndex(string(id), ".")
+	if lastDot < 0 {
+		return ast.Location{}, false
+	}
+	m, ok := s.parsedModules[ast.QualifiedIdentifier(id[:lastDot])]
+	if !ok || m == nil {
+		return ast.Location{}, false
+	}
+	name := ast.Identifier(id[lastDot+1:])
+	if dt, ok := common.Find(func(d parsed.DataType) bool { return d.Name() == name }, m.DataTypes()); ok {
+		return identifierLocation(dt.Location(), name, false)
+	}
+	if alias, ok := common.Find(func(a parsed.Alias) bool { return a.Name() == name }, m.Aliases()); ok {
+		return identifierLocation(alias.Location(), name, false)
+	}
+	return ast.Location{}, false
+}
+
+func (s *server) references(
+	uri protocol.DocumentURI, position protocol.Position, includeDeclaration bool,
+) []protocol.Location {
+	loc, m, ok := s.locationUnderCursor(uri, position.Line, position.Character)
+	if !ok {
+		return nil
+	}
+	var result []protocol.Location
+	_, occurrences := s.occurrences(loc, m)
+	for _, o := range occurrences {
+		if includeDeclaration || !o.declaration {
+			result = append(result, *locToLocation(o.location))
+		}
+	}
+	return result
+}
+
+// documentHighlight marks occurrences of the symbol under the cursor in the current file,
+// the declaration is marked as Write and uses as Read
+func (s *server) documentHighlight(uri protocol.DocumentURI, position protocol.Position) []protocol.DocumentHighlight {
+	loc, m, ok := s.locationUnderCursor(uri, position.Line, position.Character)
+	if !ok {
+		return nil
+	}
+	var result []protocol.DocumentHighlight
+	seen := map[uint32]struct{}{}
+	name, occurrences := s.occurrences(loc, m)
+	for _, o := range occurrences {
+		if o.location.FilePath() != loc.FilePath() {
+			continue
+		}
+		l := o.location
+		if identLoc, ok := identifierLocation(l, name, false); ok {
+			l = identLoc
+		}
+		if _, ok := seen[l.Start()]; ok {
+			continue
+		}
+		seen[l.Start()] = struct{}{}
+		kind := protocol.Read
+		if o.declaration {
+			kind = protocol.Write
+		}
+		result = append(result, protocol.DocumentHighlight{Range: locToRange(l), Kind: kind})
+	}
+	return result
+}
+
+// localUses returns locations of local variables that refer to the pattern
+func localUses(m *parsed.Module, pattern typed.Pattern) []definitionUse {
+	var uses []definitionUse
+	m.Iterate(func(stmt parsed.Statement) {
+		if nStmt := stmt.Successor(); nStmt != nil {
+			if l, ok := nStmt.Successor().(*typed.Local); ok && l.Target() == pattern {
+				uses = append(uses, definitionUse{location: stmt.Location(), module: m.Name()})
+			}
+		}
+	})
+	return uses
+}
@@ -0,0 +1,632 @@
+package internal
+
+import (
+	"fmt"
+	"github.com/nar-lang/nar-compiler"
+	"github.com/nar-lang/nar-compiler/ast"
+	"github.com/nar-lang/nar-compiler/ast/normalized"
+	"github.com/nar-lang/nar-compiler/ast/parsed"
+	"github.com/nar-lang/nar-compiler/ast/typed"
+	"github.com/nar-lang/nar-compiler/common"
+	"github.com/nar/internal/protocol"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// renameTarget is a symbol with locations of all its occurrences. Every location covers exactly
+// the identifier, so qualifiers of references and type annotations of patterns stay untouched.
+type renameTarget struct {
+	name      ast.Identifier
+	locations []ast.Location
+	seen      map[string]struct{}
+	collides  func(newName ast.Identifier) string
+}
+
+func (t *renameTarget) add(loc ast.Location, ok bool) {
+	if !ok {
+		return
+	}
+	key := fmt.Sprintf("%s:%d", loc.FilePath(), loc.Start())
+	if _, seen := t.seen[key]; !seen {
+		t.seen[key] = struct{}{}
+		t.locations = append(t.locations, loc)
+	}
+}
+
+func renameError(format string, args ...any) error {
+	return rpcError{Code: rpcRequestFailed, Message: fmt.Sprintf(format, args...)}
+}
+
+func (s *server) prepareRename(uri protocol.DocumentURI, position protocol.Position) (*protocol.PrepareRenameResult, error) {
+	loc, m, ok := s.locationUnderCursor(uri, position.Line, position.Character)
+	if !ok {
+		return nil, nil
+	}
+	if start, end, ok := moduleHeader(loc.FileContent()); ok && start <= int(loc.Start()) && int(loc.Start()) <= end {
+		return &protocol.PrepareRenameResult{
+			Range:       locToRange(ast.NewLocation(loc.FilePath(), loc.FileContent(), uint32(start), uint32(end))),
+			Placeholder: string(m.Name()),
+		}, nil
+	}
+	target, identLoc, err := s.renameTarget(loc, m)
+	if err != nil {
+		return nil, err
+	}
+	return &protocol.PrepareRenameResult{Range: locToRange(identLoc), Placeholder: string(target.name)}, nil
+}
+
+func (s *server) rename(
+	uri protocol.DocumentURI, position protocol.Position, newName string,
+) (*protocol.WorkspaceEdit, error) {
+	loc, m, ok := s.locationUnderCursor(uri, position.Line, position.Character)
+	if !ok {
+		return nil, nil
+	}
+	if start, end, ok := moduleHeader(loc.FileContent()); ok && start <= int(loc.Start()) && int(loc.Start()) <= end {
+		return s.renameModule(m, newName)
+	}
+	target, _, err := s.renameTarget(loc, m)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateNewName(target.name, newName); err != nil {
+		return nil, err
+	}
+	if ast.Identifier(newName) == target.name {
+		return &protocol.WorkspaceEdit{}, nil
+	}
+	if reason := target.collides(ast.Identifier(newName)); reason != "" {
+		return nil, renameError("cannot rename `%s` to `%s`: %s", target.name, newName, reason)
+	}
+
+	result := &protocol.WorkspaceEdit{Changes: map[protocol.DocumentURI][]protocol.TextEdit{}}
+	for _, l := range target.locations {
+		fileUri := pathToUri(l.FilePath())
+		result.Changes[fileUri] = append(result.Changes[fileUri], protocol.TextEdit{
+			Range:   locToRange(l),
+			NewText: newName,
+		})
+	}
+	return result, nil
+}
+
+// renameTarget finds symbol under the cursor and returns it with location of the identifier under the cursor
+func (s *server) renameTarget(loc ast.Location, m *parsed.Module) (*renameTarget, ast.Location, error) {
+	text := loc.FileContent()
+	start, end := identifierSegmentAt(text, int(loc.Start()))
+	if start == end {
+		return nil, ast.Location{}, renameError("nothing to rename at this position")
+	}
+	word := ast.Identifier(text[start:end])
+	identLoc := ast.NewLocation(loc.FilePath(), text, uint32(start), uint32(end))
+	if slices.Contains(nar_compiler.Keywords, string(word)) {
+		return nil, identLoc, renameError("keyword `%s` cannot be renamed", word)
+	}
+
+	var target *renameTarget
+	var err error
+	_, nStmt, tStmt := s.statementAtLocation(loc, m)
+	switch e := tStmt.(type) {
+	case *typed.Global:
+		target, err = s.definitionRenameTarget(e.Definition())
+	case *typed.POption:
+		target, err = s.definitionRenameTarget(e.Definition())
+	case *typed.Definition:
+		target, err = s.definitionRenameTarget(e)
+	case *typed.Local:
+		target, err = s.localRenameTarget(e.Target(), word, m)
+	case *typed.TData:
+		target, err = s.dataTypeRenameTarget(e.Name())
+	case *typed.TNative:
+		err = renameError("native type `%s` cannot be renamed", word)
+	case typed.Pattern:
+		switch nStmt.(type) {
+		case *normalized.PNamed, *normalized.PAlias:
+			target, err = s.localRenameTarget(e, word, m)
+		}
+	}
+	if err != nil {
+		return nil, identLoc, err
+	}
+	if target == nil || target.name != word {
+		return nil, identLoc, renameError("`%s` cannot be renamed", word)
+	}
+	return target, identLoc, nil
+}
+
+func (s *server) definitionRenameTarget(def *typed.Definition) (*renameTarget, error) {
+	if def == nil {
+		return nil, nil
+	}
+	m := s.moduleOfLocation(def.Location())
+	if m == nil {
+		return nil, nil
+	}
+	if s.isCached(m) {
+		return nil, renameError("`%s` is defined in cached package %s", def.Name(), m.PackageName())
+	}
+	if pDef, ok := common.Find(func(d parsed.Definition) bool { return d.Name() == def.Name() }, m.Definitions()); ok {
+		if _, native := pDef.Body().(*parsed.Call); native {
+			return nil, renameError("native definition `%s` cannot be renamed", def.Name())
+		}
+	}
+
+	target := &renameTarget{name: def.Name(), seen: map[string]struct{}{}}
+	target.add(identifierLocation(def.NameLocation(), def.Name(), false))
+	referencingModules := []*parsed.Module{m}
+	if id, ok := s.definitionIdentifier(def); ok {
+		for _, use := range s.index.uses[id] {
+			target.add(identifierLocation(use.location, def.Name(), false))
+			if mod, ok := s.parsedModules[use.module]; ok && mod != nil && !slices.Contains(referencingModules, mod) {
+				referencingModules = append(referencingModules, mod)
+			}
+		}
+	}
+	for _, mod := range s.parsedModules {
+		if mod != nil {
+			for _, l := range exposingLocations(mod, m.Name(), def.Name()) {
+				target.add(l, true)
+			}
+		}
+	}
+
+	target.collides = func(newName ast.Identifier) string {
+		for _, mod := range referencingModules {
+			if _, ok := common.Find(func(d parsed.Definition) bool { return d.Name() == newName }, mod.Definitions()); ok {
+				return fmt.Sprintf("`%s` is already defined in %s", newName, mod.Name())
+			}
+		}
+		return ""
+	}
+	return target, nil
+}
+
+func (s *server) localRenameTarget(pattern typed.Pattern, name ast.Identifier, m *parsed.Module) (*renameTarget, error) {
+	if pattern == nil {
+		return nil, nil
+	}
+	target := &renameTarget{name: name, seen: map[string]struct{}{}}
+	_, isAlias := pattern.(*typed.PAlias)
+	target.add(identifierLocation(pattern.Location(), name, isAlias))
+	m.Iterate(func(stmt parsed.Statement) {
+		if nStmt := stmt.Successor(); nStmt != nil {
+			if l, ok := nStmt.Successor().(*typed.Local); ok && l.Target() == pattern {
+				target.add(identifierLocation(stmt.Location(), name, false))
+			}
+		}
+	})
+
+	// a local collides with any other name declared or referenced in the same definition
+	target.collides = func(newName ast.Identifier) string {
+		def, ok := common.Find(
+			func(d parsed.Definition) bool { return d.Location().Contains(pattern.Location()) }, m.Definitions())
+		if !ok {
+			return ""
+		}
+		reason := ""
+		def.Iterate(func(stmt parsed.Statement) {
+			if stmt == nil || reason != "" {
+				return
+			}
+			switch e := stmt.Successor().(type) {
+			case *normalized.PNamed:
+				if e.Name() == newName {
+					reason = fmt.Sprintf("`%s` is already declared in `%s`", newName, def.Name())
+				}
+			case *normalized.PAlias:
+				if e.Alias() == newName {
+					reason = fmt.Sprintf("`%s` is already declared in `%s`", newName, def.Name())
+				}
+			}
+			if nStmt := stmt.Successor(); nStmt != nil && reason == "" {
+				if g, ok := nStmt.Successor().(*typed.Global); ok && g.Definition() != nil &&
+					g.Definition().Name() == newName {
+					reason = fmt.Sprintf("`%s` would shadow global `%s` used in `%s`", name, newName, def.Name())
+				}
+			}
+		})
+		return reason
+	}
+	return target, nil
+}
+
+func (s *server) dataTypeRenameTarget(fullName ast.FullIdentifier) (*renameTarget, error) {
+	lastDot := strings.LastIndex(string(fullName), ".")
+	if lastDot < 0 {
+		return nil, nil
+	}
+	m, ok := s.parsedModules[ast.QualifiedIdentifier(fullName[:lastDot])]
+	if !ok || m == nil {
+		return nil, nil
+	}
+	name := ast.Identifier(fullName[lastDot+1:])
+	dt, ok := common.Find(func(d parsed.DataType) bool { return d.Name() == name }, m.DataTypes())
+	if !ok {
+		return nil, nil
+	}
+	if s.isCached(m) {
+		return nil, renameError("`%s` is defined in cached package %s", name, m.PackageName())
+	}
+
+	target := &renameTarget{name: name, seen: map[string]struct{}{}}
+	target.add(identifierLocation(dt.Location(), name, false))
+	for _, use := range s.index.typeUses[fullName] {
+		target.add(identifierLocation(use.location, name, false))
+	}
+	for _, mod := range s.parsedModules {
+		if mod != nil {
+			for _, l := range exposingLocations(mod, m.Name(), name) {
+				target.add(l, true)
+			}
+		}
+	}
+
+	target.collides = func(newName ast.Identifier) string {
+		_, isDataType := common.Find(func(d parsed.DataType) bool { return d.Name() == newName }, m.DataTypes())
+		_, isAlias := common.Find(func(a parsed.Alias) bool { return a.Name() == newName }, m.Aliases())
+		if isDataType || isAlias {
+			return fmt.Sprintf("type `%s` is already defined in %s", newName, m.Name())
+		}
+		return ""
+	}
+	return target, nil
+}
+
+func (s *server) isCached(m *parsed.Module) bool {
+	if s.cacheDir == "" {
+		return false
+	}
+	rel, err := filepath.Rel(s.cacheDir, m.Location().FilePath())
+	return err == nil && !strings.HasPrefix(rel, "..")
+}
+
+// validateNewName checks that new name is a valid identifier of the same kind as the old one.
+// Names of types and data options start with upper case letter, names of values with lower case.
+func validateNewName(oldName ast.Identifier, newName string) error {
+	if newName == "" {
+		return renameError("new name is empty")
+	}
+	if slices.Contains(nar_compiler.Keywords, newName) {
+		return renameError("`%s` is a keyword", newName)
+	}
+	if !isValidIdentifier(newName) {
+		return renameError("`%s` is not a valid identifier", newName)
+	}
+	oldUpper := unicode.IsUpper([]rune(oldName)[0])
+	newUpper := unicode.IsUpper([]rune(newName)[0])
+	if oldUpper && !newUpper {
+		return renameError("`%s` should start with upper case letter", newName)
+	}
+	if !oldUpper && newUpper {
+		return renameError("`%s` should start with lower case letter", newName)
+	}
+	return nil
+}
+
+// identifierSegmentAt returns bounds of the identifier under the cursor without module qualifier
+func identifierSegmentAt(text []rune, cursor int) (int, int) {
+	isSegmentChar := func(c rune) bool { return c != '.' && isIdentChar(c) }
+	cursor = min(cursor, len(text))
+	start := cursor
+	for start > 0 && isSegmentChar(text[start-1]) {
+		start--
+	}
+	end := cursor
+	for end < len(text) && isSegmentChar(text[end]) {
+		end++
+	}
+	return start, end
+}
+
+// identifierLocation returns location of the first (or last) occurrence of the name as a whole
+// identifier (or last segment of qualified identifier) inside given location
+func identifierLocation(loc ast.Location, name ast.Identifier, last bool) (ast.Location, bool) {
+	text := loc.FileContent()
+	found := -1
+	for i := int(loc.Start()); i < int(loc.End()); i++ {
+		if at := identifierAt(text, i, name); at {
+			found = i
+			if !last {
+				break
+			}
+		}
+	}
+	if found < 0 {
+		return ast.Location{}, false
+	}
+	return ast.NewLocation(loc.FilePath(), text, uint32(found), uint32(found+len([]rune(name)))), true
+}
+
+func identifierAt(text []rune, i int, name ast.Identifier) bool {
+	runes := []rune(name)
+	end := i + len(runes)
+	if end > len(text) || string(text[i:end]) != string(name) {
+		return false
+	}
+	return (i == 0 || !isIdentChar(text[i-1]) || text[i-1] == '.') && (end == len(text) || !isIdentChar(text[end]))
+}
+
+// exposingLocations returns locations of the name in exposing lists of imports of the module
+func exposingLocations(m *parsed.Module, imported ast.QualifiedIdentifier, name ast.Identifier) []ast.Location {
+	text := m.Location().FileContent()
+	imports, _ := scanImports(text)
+	var locations []ast.Location
+	for _, imp := range imports {
+		if imp.module != imported || imp.listStart < 0 {
+			continue
+		}
+		for i := imp.listStart + 1; i < imp.listEnd; i++ {
+			if identifierAt(text, i, name) {
+				locations = append(locations,
+					ast.NewLocation(m.Location().FilePath(), text, uint32(i), uint32(i+len([]rune(name)))))
+			}
+		}
+	}
+	return locations
+}
+
+// editSet collects text edits grouped by file ignoring duplicates
+type editSet struct {
+	edits map[protocol.DocumentURI][]protocol.TextEdit
+	seen  map[string]struct{}
+}
+
+func newEditSet() *editSet {
+	return &editSet{edits: map[protocol.DocumentURI][]protocol.TextEdit{}, seen: map[string]struct{}{}}
+}
+
+func (e *editSet) replace(path string, text []rune, start int, end int, newText string) {
+	key := fmt.Sprintf("%s:%d", path, start)
+	if _, seen := e.seen[key]; seen {
+		return
+	}
+	e.seen[key] = struct{}{}
+	uri := pathToUri(path)
+	e.edits[uri] = append(e.edits[uri], protocol.TextEdit{
+		Range:   locToRange(ast.NewLocation(path, text, uint32(start), uint32(end))),
+		NewText: newText,
+	})
+}
+
+// documentChanges converts edits to versioned document edits, versions of opened documents are
+// passed so that the client can reject edits made against outdated content,
+// other documents have null version meaning that the content on disk is the truth
+func (s *server) documentChanges(e *editSet) []protocol.DocumentChanges {
+	uris := make([]protocol.DocumentURI, 0, len(e.edits))
+	for uri := range e.edits {
+		uris = append(uris, uri)
+	}
+	slices.Sort(uris)
+	var changes []protocol.DocumentChanges
+	for _, uri := range uris {
+		var version *int32
+		if _, opened := s.openedDocuments[uri]; opened {
+			v := s.documentVersions[uri]
+			version = &v
+		}
+		changes = append(changes, protocol.DocumentChanges{
+			TextDocumentEdit: &protocol.TextDocumentEdit{
+				TextDocument: protocol.OptionalVersionedTextDocumentIdentifier{
+					Version:                version,
+					TextDocumentIdentifier: protocol.TextDocumentIdentifier{URI: uri},
+				},
+				Edits: e.edits[uri],
+			},
+		})
+	}
+	return changes
+}
+
+// renameModule changes module header, imports and qualified references of the module
+// and moves its file if the file name follows the module name
+func (s *server) renameModule(m *parsed.Module, newName string) (*protocol.WorkspaceEdit, error) {
+	if err := validateModuleName(newName); err != nil {
+		return nil, err
+	}
+	if ast.QualifiedIdentifier(newName) == m.Name() {
+		return &protocol.WorkspaceEdit{}, nil
+	}
+	if s.isCached(m) {
+		return nil, renameError("module %s belongs to cached package %s", m.Name(), m.PackageName())
+	}
+	if existing, ok := s.parsedModules[ast.QualifiedIdentifier(newName)]; ok && existing != nil {
+		return nil, renameError("module %s already exists", newName)
+	}
+
+	edits := newEditSet()
+	s.moduleRenameEdits(m, ast.QualifiedIdentifier(newName), edits)
+	changes := s.documentChanges(edits)
+	path := m.Location().FilePath()
+	if newPath, ok := modulePath(path, m.Name(), ast.QualifiedIdentifier(newName)); ok && newPath != path {
+		changes = append(changes, protocol.DocumentChanges{
+			RenameFile: &protocol.RenameFile{
+				Kind:   "rename",
+				OldURI: pathToUri(path),
+				NewURI: pathToUri(newPath),
+			},
+		})
+	}
+	return &protocol.WorkspaceEdit{DocumentChanges: changes}, nil
+}
+
+// willRenameFiles updates module headers, imports and qualified references of the modules
+// which files are going to be moved, new module names follow new file paths
+func (s *server) willRenameFiles(files []protocol.FileRename) *protocol.WorkspaceEdit {
+	edits := newEditSet()
+	for _, f := range files {
+		oldPath := uriToPath(protocol.DocumentURI(f.OldURI))
+		newPath := uriToPath(protocol.DocumentURI(f.NewURI))
+		for _, m := range s.parsedModules {
+			if m == nil || s.isCached(m) {
+				continue
+			}
+			path := m.Location().FilePath()
+			movedTo := newPath
+			if path != oldPath {
+				rel, ok := strings.CutPrefix(path, oldPath+string(filepath.Separator))
+				if !ok {
+					continue
+				}
+				movedTo = filepath.Join(newPath, rel)
+			}
+			if newName, ok := moduleNameForPath(path, movedTo, m.Name()); ok && newName != m.Name() {
+				s.moduleRenameEdits(m, newName, edits)
+			}
+		}
+	}
+	if len(edits.edits) == 0 {
+		return nil
+	}
+	return &protocol.WorkspaceEdit{DocumentChanges: s.documentChanges(edits)}
+}
+
+func (s *server) moduleRenameEdits(m *parsed.Module, newName ast.QualifiedIdentifier, edits *editSet) {
+	oldName := m.Name()
+	path := m.Location().FilePath()
+	if start, end, ok := moduleHeader(m.Location().FileContent()); ok {
+		edits.replace(path, m.Location().FileContent(), start, end, string(newName))
+	}
+
+	aliases := map[ast.QualifiedIdentifier]map[string]struct{}{}
+	for _, mod := range s.parsedModules {
+		if mod == nil {
+			continue
+		}
+		modPath := mod.Location().FilePath()
+		text := mod.Location().FileContent()
+		imports, _ := scanImports(text)
+		aliases[mod.Name()] = map[string]struct{}{}
+		for _, imp := range imports {
+			if imp.module == oldName {
+				edits.replace(modPath, text, imp.moduleStart, imp.moduleStart+len([]rune(oldName)), string(newName))
+			}
+			if imp.alias != "" {
+				aliases[mod.Name()][string(imp.alias)] = struct{}{}
+			}
+		}
+	}
+
+	for _, use := range s.index.moduleUses(oldName) {
+		text := use.location.FileContent()
+		start := int(use.location.Start())
+		end := start
+		for end < int(use.location.End()) && isIdentChar(text[end]) {
+			end++
+		}
+		lastDot := strings.LastIndex(string(text[start:end]), ".")
+		if lastDot < 0 {
+			continue
+		}
+		qualifier := string(text[start:end])[:lastDot]
+		if _, isAlias := aliases[use.module][qualifier]; isAlias {
+			continue
+		}
+		if replacement, ok := renamedQualifier(qualifier, oldName, newName); ok {
+			edits.replace(use.location.FilePath(), text, start, start+len([]rune(qualifier)), replacement)
+		}
+	}
+}
+
+// renamedQualifier returns new qualifier for the reference qualified with full
+// or shortened (last segments only) name of the renamed module
+func renamedQualifier(qualifier string, oldName ast.QualifiedIdentifier, newName ast.QualifiedIdentifier) (string, bool) {
+	if qualifier == string(oldName) {
+		return string(newName), true
+	}
+	if !strings.HasSuffix(string(oldName), "."+qualifier) {
+		return "", false
+	}
+	segments := strings.Split(string(newName), ".")
+	n := min(strings.Count(qualifier, ".")+1, len(segments))
+	return strings.Join(segments[len(segments)-n:], "."), true
+}
+
+// moduleHeader returns bounds of the module name in the `module` header
+func moduleHeader(text []rune) (int, int, bool) {
+	pos := 0
+	for pos < len(text) {
+		lineEnd := pos
+		for lineEnd < len(text) && text[lineEnd] != '\n' {
+			lineEnd++
+		}
+		line := string(text[pos:lineEnd])
+		if trimmed := strings.TrimLeftFunc(line, unicode.IsSpace); strings.HasPrefix(trimmed, nar_compiler.KwModule+" ") {
+			start := pos + len([]rune(line)) - len([]rune(trimmed)) + len(nar_compiler.KwModule)
+			for start < lineEnd && unicode.IsSpace(text[start]) {
+				start++
+			}
+			end := start
+			for end < lineEnd && isIdentChar(text[end]) {
+				end++
+			}
+			return start, end, start < end
+		}
+		pos = lineEnd + 1
+	}
+	return 0, 0, false
+}
+
+// moduleSuffixLength returns number of trailing module name segments that match
+// trailing path components (directories and file name without extension)
+func moduleSuffixLength(path string, name ast.QualifiedIdentifier) (int, []string) {
+	components := strings.Split(strings.TrimSuffix(filepath.ToSlash(path), filepath.Ext(path)), "/")
+	segments := strings.Split(string(name), ".")
+	k := 0
+	for k < len(segments) && k < len(components) &&
+		components[len(components)-1-k] == segments[len(segments)-1-k] {
+		k++
+	}
+	return k, components
+}
+
+// modulePath returns new path of the module file after renaming the module
+func modulePath(path string, oldName ast.QualifiedIdentifier, newName ast.QualifiedIdentifier) (string, bool) {
+	k, components := moduleSuffixLength(path, oldName)
+	if k == 0 {
+		return "", false
+	}
+	segments := strings.Split(string(newName), ".")
+	if k < len(strings.Split(string(oldName), ".")) {
+		segments = segments[len(segments)-min(k, len(segments)):]
+	}
+	components = append(components[:len(components)-k], segments...)
+	return filepath.FromSlash(strings.Join(components, "/")) + filepath.Ext(path), true
+}
+
+// moduleNameForPath returns new name of the module which file is moved from oldPath to newPath
+func moduleNameForPath(oldPath string, newPath string, name ast.QualifiedIdentifier) (ast.QualifiedIdentifier, bool) {
+	if filepath.Ext(newPath) != filepath.Ext(oldPath) {
+		return "", false
+	}
+	k, _ := moduleSuffixLength(oldPath, name)
+	newComponents := strings.Split(strings.TrimSuffix(filepath.ToSlash(newPath), filepath.Ext(newPath)), "/")
+	if k == 0 || k > len(newComponents) {
+		return "", false
+	}
+	segments := strings.Split(string(name), ".")
+	newName := strings.Join(append(segments[:len(segments)-k], newComponents[len(newComponents)-k:]...), ".")
+	if validateModuleName(newName) != nil {
+		return "", false
+	}
+	return ast.QualifiedIdentifier(newName), true
+}
+
+func validateModuleName(name string) error {
+	for _, segment := range strings.Split(name, ".") {
+		if slices.Contains(nar_compiler.Keywords, segment) || !isValidIdentifier(segment) {
+			return renameError("`%s` is not a valid module name", name)
+		}
+	}
+	return nil
+}
+
+func isValidIdentifier(name string) bool {
+	for i, c := range name {
+		if !unicode.IsLetter(c) && (i == 0 || (c != '_' && c != '`' && !unicode.IsDigit(c))) {
+			return false
+		}
+	}
+	return name != ""
+}
@@ -0,0 +1,218 @@
+package internal
+
+import (
+	"encoding/json"
+	"github.com/nar-lang/nar-compiler/ast"
+	"github.com/nar-lang/nar-compiler/common"
+	"github.com/nar/internal/protocol"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateNewName(t *testing.T) {
+	tests := []struct {
+		oldName string
+		newName string
+		// err is a part of the error message, empty if the name is valid
+		err string
+	}{
+		{oldName: "value", newName: "other"},
+		{oldName: "value", newName: "value2"},
+		{oldName: "value", newName: "snake_case"},
+		{oldName: "Color", newName: "Shade"},
+		{oldName: "value", newName: "", err: "new name is empty"},
+		{oldName: "value", newName: "def", err: "`def` is a keyword"},
+		{oldName: "value", newName: "2value", err: "is not a valid identifier"},
+		{oldName: "value", newName: "_value", err: "is not a valid identifier"},
+		{oldName: "value", newName: "a-b", err: "is not a valid identifier"},
+		{oldName: "value", newName: "A.b", err: "is not a valid identifier"},
+		{oldName: "Color", newName: "color", err: "should start with upper case letter"},
+		{oldName: "value", newName: "Value", err: "should start with lower case letter"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.oldName+" to "+tt.newName, func(t *testing.T) {
+			checkError(t, validateNewName(ast.Identifier(tt.oldName), tt.newName), tt.err)
+		})
+	}
+}
+
+func TestValidateModuleName(t *testing.T) {
+	tests := []struct {
+		name string
+		err  string
+	}{
+		{name: "Main"},
+		{name: "Pkg.Sub.Main"},
+		{name: "", err: "is not a valid module name"},
+		{name: "Pkg..Main", err: "is not a valid module name"},
+		{name: "Pkg.Main.", err: "is not a valid module name"},
+		{name: "Pkg.def", err: "is not a valid module name"},
+		{name: "Pkg.1Main", err: "is not a valid module name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkError(t, validateModuleName(tt.name), tt.err)
+		})
+	}
+}
+
+var renameTestSources = map[string]string{
+	"A.nar": `module Test.A
+
+type Color = Red | Green
+
+type Shade = Light
+
+def paint(c: Color): Color = c
+
+def mix(a: Color, b: Color): Color =
+  let c = paint(a) in paint(b)
+`,
+	"B.nar": `module Test.B
+
+import Test.A exposing (paint, Color)
+
+def brush(c: Color): Color = paint(c)
+`,
+}
+
+func TestRenameCollisions(t *testing.T) {
+	s, root := newTestServer(t, renameTestSources)
+	tests := []struct {
+		name string
+		file string
+		// at is a text, the cursor is placed at its first occurrence in the file
+		at      string
+		newName string
+		// err is a part of the error message, empty if rename succeeds
+		err string
+		// edits is the number of expected edits if rename succeeds
+		edits int
+	}{
+		{name: "definition", file: "A.nar", at: "paint(c:", newName: "tint", edits: 5},
+		{name: "definition to the same name", file: "A.nar", at: "paint(c:", newName: "paint"},
+		{name: "definition of the module", file: "A.nar", at: "paint(c:", newName: "mix",
+			err: "`mix` is already defined in Test.A"},
+		{name: "definition of referencing module", file: "A.nar", at: "paint(c:", newName: "brush",
+			err: "`brush` is already defined in Test.B"},
+		{name: "definition from referencing module", file: "B.nar", at: "paint(c)", newName: "mix",
+			err: "`mix` is already defined in Test.A"},
+		{name: "definition to type name", file: "A.nar", at: "paint(c:", newName: "Paint",
+			err: "should start with lower case letter"},
+		{name: "parameter", file: "A.nar", at: "a: Color", newName: "x", edits: 2},
+		{name: "parameter to other parameter", file: "A.nar", at: "a: Color", newName: "b",
+			err: "`b` is already declared in `mix`"},
+		{name: "parameter to let binding", file: "A.nar", at: "a: Color", newName: "c",
+			err: "`c` is already declared in `mix`"},
+		{name: "parameter to used global", file: "A.nar", at: "a: Color", newName: "paint",
+			err: "would shadow global `paint` used in `mix`"},
+		{name: "let binding", file: "A.nar", at: "c = paint", newName: "d", edits: 1},
+		{name: "data type", file: "A.nar", at: "Color =", newName: "Hue", edits: 9},
+		{name: "data type to other data type", file: "A.nar", at: "Color =", newName: "Shade",
+			err: "type `Shade` is already defined in Test.A"},
+		{name: "keyword", file: "A.nar", at: "def mix", newName: "other",
+			err: "keyword `def` cannot be renamed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uri := pathToUri(filepath.Join(root, "src", tt.file))
+			text := renameTestSources[tt.file]
+			offset := strings.Index(text, tt.at)
+			if offset < 0 {
+				t.Fatalf("%q is not found in %s", tt.at, tt.file)
+			}
+			line := strings.Count(text[:offset], "\n")
+			char := offset - strings.LastIndex(text[:offset], "\n") - 1
+			edit, err := s.rename(uri, protocol.Position{Line: uint32(line), Character: uint32(char)}, tt.newName)
+			checkError(t, err, tt.err)
+			if err != nil {
+				return
+			}
+			if edit == nil {
+				t.Fatal("nothing to rename")
+			}
+			edits := 0
+			for _, e := range edit.Changes {
+				edits += len(e)
+			}
+			if edits != tt.edits {
+				t.Errorf("rename has %d edits, expected %d: %v", edits, tt.edits, edit.Changes)
+			}
+		})
+	}
+}
+
+// newTestServer writes sources to src directory of a temporary package, opens one of them and waits
+// until the package is compiled without errors. Returns the server and the package root.
+func newTestServer(t *testing.T, sources map[string]string) (*server, string) {
+	root := t.TempDir()
+	write := func(path string, content string) {
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("nar.json", `{"name":"Test","version":1,"nar-version":100,"dependencies":{}}`)
+	for name, content := range sources {
+		write(filepath.Join("src", name), content)
+	}
+
+	diagnostics := make(chan protocol.PublishDiagnosticsParams, 128)
+	s := NewServer(t.TempDir(), func(msg []byte) {
+		var n struct {
+			Method string                            `json:"method"`
+			Params protocol.PublishDiagnosticsParams `json:"params"`
+		}
+		if json.Unmarshal(msg, &n) == nil && n.Method == "textDocument/publishDiagnostics" {
+			diagnostics <- n.Params
+		}
+	}).(*server)
+	t.Cleanup(s.Close)
+
+	id := 0
+	send := func(method string, params any) {
+		id++
+		msg, _ := json.Marshal(map[string]any{"jsonrpc": "2.0", "id": id, "method": method, "params": params})
+		s.GotMessage(msg)
+	}
+	send("initialize", map[string]any{"rootUri": pathToUri(root), "capabilities": map[string]any{}})
+	send("initialized", map[string]any{})
+	// opened document loads the whole package, so all sources are compiled at once
+	names := common.Keys(sources)
+	slices.Sort(names)
+	send("textDocument/didOpen", map[string]any{"textDocument": map[string]any{
+		"uri": pathToUri(filepath.Join(root, "src", names[0])), "languageId": "nar", "version": 1, "text": sources[names[0]],
+	}})
+
+	reported := map[protocol.DocumentURI]struct{}{}
+	timeout := time.After(10 * time.Second)
+	for len(reported) < len(sources) {
+		select {
+		case d := <-diagnostics:
+			for _, e := range d.Diagnostics {
+				t.Fatalf("%s: %s", d.URI, e.Message)
+			}
+			reported[d.URI] = struct{}{}
+		case <-timeout:
+			t.Fatalf("package is not compiled")
+		}
+	}
+	return s, root
+}
+
+func checkError(t *testing.T, err error, expected string) {
+	t.Helper()
+	if expected == "" && err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if expected != "" && (err == nil || !strings.Contains(err.Error(), expected)) {
+		t.Errorf("error is %v, expected %q", err, expected)
+	}
+}
@@ -4,14 +4,11 @@ import (
 	"fmt"
 	"github.com/nar-lang/nar-compiler"
 	"github.com/nar-lang/nar-compiler/ast"
-	"github.com/nar-lang/nar-compiler/ast/normalized"
 	"github.com/nar-lang/nar-compiler/ast/parsed"
 	"github.com/nar-lang/nar-compiler/ast/typed"
 	"github.com/nar-lang/nar-compiler/common"
 	"github.com/nar-lang/nar-compiler/locator"
 	"github.com/nar/internal/protocol"
-	"slices"
-	"strings"
 	"unicode"
 )
 
@@ -23,11 +20,26 @@ func (s *server) Initialize(params *protocol.InitializeParams) (protocol.Initial
 	if params.Trace != nil {
 		s.trace = *params.Trace
 	}
+	s.snippetSupport = params.Capabilities.TextDocument.Completion.CompletionItem.SnippetSupport
+	s.progressSupport = params.Capabilities.Window.WorkDoneProgress
+	s.pullDiagnostics = params.Capabilities.TextDocument.Diagnostic != nil
+	s.diagnosticsRefreshSupport = params.Capabilities.Workspace.Diagnostics != nil &&
+		params.Capabilities.Workspace.Diagnostics.RefreshSupport
+	s.semanticTokensRefresh = params.Capabilities.Workspace.SemanticTokens != nil &&
+		params.Capabilities.Workspace.SemanticTokens.RefreshSupport
+	s.watchFilesSupport = params.Capabilities.Workspace.DidChangeWatchedFiles.DynamicRegistration
 	for _, f := range params.WorkspaceFolders {
-		s.workspaceProviders = append(s.workspaceProviders,
-			locator.NewDirectoryProvider(uriToPath(protocol.DocumentURI(f.URI))))
+		s.workspaceFolders = append(s.workspaceFolders, uriToPath(protocol.DocumentURI(f.URI)))
+	}
+	// clients without workspace folders support send the only folder as the root
+	if len(s.workspaceFolders) == 0 && s.rootURI != "" {
+		s.workspaceFolders = append(s.workspaceFolders, uriToPath(s.rootURI))
+	}
+	for _, folder := range s.workspaceFolders {
+		s.workspaceProviders = append(s.workspaceProviders, locator.NewDirectoryProvider(folder))
 	}
 
+	folderPattern := protocol.FolderPattern
 	return protocol.InitializeResult{
 		Capabilities: protocol.ServerCapabilities{
 			TextDocumentSync: &protocol.TextDocumentSyncOptions{
@@ -46,31 +58,68 @@ func (s *server) Initialize(params *protocol.InitializeParams) (protocol.Initial
 			HoverProvider: &protocol.Or_ServerCapabilities_hoverProvider{
 				Value: true,
 			},
+			DocumentHighlightProvider: &protocol.Or_ServerCapabilities_documentHighlightProvider{
+				Value: protocol.DocumentHighlightOptions{},
+			},
 			DocumentSymbolProvider: &protocol.Or_ServerCapabilities_documentSymbolProvider{
 				Value: protocol.DocumentSymbolOptions{},
 			},
 			SemanticTokensProvider: &protocol.SemanticTokensOptions{
 				Legend: protocol.SemanticTokensLegend{
 					TokenTypes:     ast.SemanticTokenTypesLegend,
-					TokenModifiers: ast.SemanticTokenModifiersLegend,
+					TokenModifiers: semanticTokenModifiersLegend,
 				},
 				Range: &protocol.Or_SemanticTokensOptions_range{
-					Value: false,
+					Value: true,
 				},
 				Full: &protocol.Or_SemanticTokensOptions_full{
 					Value: protocol.PFullESemanticTokensOptions{
-						Delta: false,
+						Delta: true,
 					},
 				},
 			},
 			CompletionProvider: &protocol.CompletionOptions{
 				TriggerCharacters: []string{"."},
+				ResolveProvider:   true,
 			},
 			SignatureHelpProvider: &protocol.SignatureHelpOptions{
 				TriggerCharacters:   []string{"("},
 				RetriggerCharacters: []string{","},
 			},
-			RenameProvider: &protocol.RenameOptions{},
+			RenameProvider: &protocol.RenameOptions{PrepareProvider: true},
+			CallHierarchyProvider: &protocol.Or_ServerCapabilities_callHierarchyProvider{
+				Value: protocol.CallHierarchyOptions{},
+			},
+			CodeLensProvider: &protocol.CodeLensOptions{},
+			ExecuteCommandProvider: &protocol.ExecuteCommandOptions{
+				Commands: serverCommands,
+			},
+			FoldingRangeProvider: &protocol.Or_ServerCapabilities_foldingRangeProvider{
+				Value: protocol.FoldingRangeOptions{},
+			},
+			SelectionRangeProvider: &protocol.Or_ServerCapabilities_selectionRangeProvider{
+				Value: protocol.SelectionRangeOptions{},
+			},
+			DiagnosticProvider: &protocol.Or_ServerCapabilities_diagnosticProvider{
+				Value: protocol.DiagnosticOptions{
+					InterFileDependencies: true,
+					WorkspaceDiagnostics:  true,
+				},
+			},
+			Workspace: &protocol.Workspace6Gn{
+				WorkspaceFolders: &protocol.WorkspaceFolders5Gn{
+					Supported:           true,
+					ChangeNotifications: "nar/workspaceFolders",
+				},
+				FileOperations: &protocol.FileOperationOptions{
+					WillRename: &protocol.FileOperationRegistrationOptions{
+						Filters: []protocol.FileOperationFilter{
+							{Scheme: "file", Pattern: protocol.FileOperationPattern{Glob: "**/*.nar"}},
+							{Scheme: "file", Pattern: protocol.FileOperationPattern{Glob: "**/*", Matches: &folderPattern}},
+						},
+					},
+				},
+			},
 		},
 		ServerInfo: &protocol.PServerInfoMsg_initialize{
 			Name:    "Nar Language Server",
@@ -81,6 +130,9 @@ func (s *server) Initialize(params *protocol.InitializeParams) (protocol.Initial
 
 func (s *server) Initialized(_ *nothing) error {
 	s.initialized = true
+	if s.watchFilesSupport {
+		s.registerFileWatchers()
+	}
 	return nil
 }
 
@@ -96,6 +148,7 @@ func (s *server) S_setTraceNotification(params *protocol.SetTraceParams) error {
 
 func (s *server) TextDocument_didOpen(params *protocol.DidOpenTextDocumentParams) error {
 	s.setDocumentStatus(params.TextDocument.URI, true)
+	s.documentVersions[params.TextDocument.URI] = params.TextDocument.Version
 	if pvd, ok := s.getProvider(params.TextDocument.URI); ok {
 		pvd.OverrideFile(params.TextDocument.URI, []rune(params.TextDocument.Text))
 		s.compileChan <- docChange{uri: params.TextDocument.URI, force: true}
@@ -104,6 +157,7 @@ func (s *server) TextDocument_didOpen(params *protocol.DidOpenTextDocumentParams
 }
 
 func (s *server) TextDocument_didChange(params *protocol.DidChangeTextDocumentParams) error {
+	s.documentVersions[params.TextDocument.URI] = params.TextDocument.Version
 	if pvd, ok := s.getProvider(params.TextDocument.URI); ok {
 		pvd.OverrideFile(params.TextDocument.URI, []rune(params.ContentChanges[0].Text))
 		s.compileChan <- docChange{uri: params.TextDocument.URI, force: false}
@@ -117,6 +171,10 @@ func (s *server) TextDocument_didClose(params *protocol.DidCloseTextDocumentPara
 		pvd.OverrideFile(params.TextDocument.URI, nil)
 	}
 	s.setDocumentStatus(params.TextDocument.URI, false)
+	delete(s.documentVersions, params.TextDocument.URI)
+	s.locker.Lock()
+	delete(s.semanticTokensResults, params.TextDocument.URI)
+	s.locker.Unlock()
 	return nil
 }
 
@@ -203,103 +261,29 @@ func (s *server) TextDocument_typeDefinition(
 
 func (s *server) TextDocument_references(
 	params *protocol.ReferenceParams,
-) (result []protocol.Location, err error) {
-	if loc, m, ok := s.locationUnderCursor(params.TextDocument.URI, params.Position.Line, params.Position.Character); ok {
-		_, _, stmt := s.statementAtLocation(loc, m)
-
-		appendDefinition := func(def *typed.Definition) {
-			result = append(result, *locToLocation(def.NameLocation()))
-			for _, m := range s.parsedModules {
-				m.Iterate(func(e parsed.Statement) {
-					nStmt := e.Successor()
-					if nStmt != nil {
-						if g, ok := nStmt.Successor().(*typed.Global); ok {
-							if g.Definition().Id() == def.Id() {
-								result = append(result, *locToLocation(e.Location()))
-							}
-						}
-					}
-				})
-			}
-		}
-
-		appendPattern := func(pattern typed.Pattern) {
-			result = append(result, *locToLocation(pattern.Location()))
-			for _, m := range s.parsedModules {
-				if pattern.Location().FilePath() == m.Location().FilePath() {
-					m.Iterate(func(stmt parsed.Statement) {
-						nStmt := stmt.Successor()
-						if nStmt != nil {
-							tStmt := nStmt.Successor()
-							if l, ok := tStmt.(*typed.Local); ok {
-								if l.Target() == pattern {
-									result = append(result, *locToLocation(stmt.Location()))
-								}
-							}
-						}
-					})
-				}
-			}
-		}
-
-		switch stmt.(type) {
-		case *typed.Global:
-			def := stmt.(*typed.Global).Definition()
-			if def != nil {
-				appendDefinition(def)
-			}
-			break
-		case *typed.Local:
-			target := stmt.(*typed.Local).Target()
-			if target != nil {
-				appendPattern(target)
-			}
-		case *typed.Definition:
-			def := stmt.(*typed.Definition)
-			appendDefinition(def)
-			break
-		case typed.Type:
-			tNative, isNative := stmt.(*typed.TNative)
-			tData, isData := stmt.(*typed.TData)
-			if isNative || isData {
-				for _, m := range s.parsedModules {
-					m.Iterate(func(e parsed.Statement) {
-						nStmt := e.Successor()
-						if nStmt != nil {
-							xNative, xIsNative := nStmt.Successor().(*typed.TNative)
-							xData, xIsData := nStmt.Successor().(*typed.TData)
-							if xIsNative && isNative && xNative.Name() == tNative.Name() {
-								result = append(result, *locToLocation(e.Location()))
-							}
-							if xIsData && isData && xData.Name() == tData.Name() {
-								result = append(result, *locToLocation(e.Location()))
-							}
-						}
-					})
-				}
-			}
-			break
-		case typed.Pattern:
-			pattern := stmt.(typed.Pattern)
-			appendPattern(pattern)
-			break
-		}
-	}
+) ([]protocol.Location, error) {
+	return s.references(params.TextDocument.URI, params.Position, params.Context.IncludeDeclaration), nil
+}
 
-	return
+func (s *server) TextDocument_documentHighlight(
+	params *protocol.DocumentHighlightParams,
+) ([]protocol.DocumentHighlight, error) {
+	return s.documentHighlight(params.TextDocument.URI, params.Position), nil
 }
 
 func (s *server) TextDocument_hover(params *protocol.HoverParams) (*protocol.Hover, error) {
 	if loc, mod, ok := s.locationUnderCursor(params.TextDocument.URI, params.Position.Line, params.Position.Character); ok {
 		_, _, stmt := s.statementAtLocation(loc, mod)
 		if stmt != nil {
-			return &protocol.Hover{
-				Contents: protocol.MarkupContent{
-					Kind:  protocol.Markdown,
-					Value: stmt.Code(mod.Name()), //TODO: make it useful
-				},
-				Range: locToRange(stmt.Location()),
-			}, nil
+			if text := s.hoverText(stmt, mod.Name()); text != "" {
+				return &protocol.Hover{
+					Contents: protocol.MarkupContent{
+						Kind:  protocol.Markdown,
+						Value: text,
+					},
+					Range: locToRange(stmt.Location()),
+				}, nil
+			}
 		}
 	}
 	return nil, nil
@@ -309,94 +293,91 @@ func (s *server) TextDocument_documentSymbol(
 	params *protocol.DocumentSymbolParams,
 ) (result []protocol.DocumentSymbol, err error) {
 	path := uriToPath(params.TextDocument.URI)
-	for _, mod := range s.parsedModules {
-		if mod.Location().FilePath() == path {
-			for _, inf := range mod.InfixFns() {
-				result = append(result, protocol.DocumentSymbol{
-					Name:           string(inf.Name()),
-					Kind:           protocol.Operator,
-					Range:          locToRange(inf.Location()),
-					SelectionRange: locToRange(inf.Location()),
-				})
-			}
-			for _, alias := range mod.Aliases() {
-				findDT := func(x parsed.DataType) bool { return alias.Name() == x.Name() }
-				if _, ok := common.Find(findDT, mod.DataTypes()); ok {
-					continue
-				}
+	if mod := s.moduleOfPath(path); mod != nil {
+		for _, inf := range mod.InfixFns() {
+			result = append(result, protocol.DocumentSymbol{
+				Name:           string(inf.Name()),
+				Kind:           protocol.Operator,
+				Range:          locToRange(inf.Location()),
+				SelectionRange: locToRange(inf.Location()),
+			})
+		}
+		for _, alias := range mod.Aliases() {
+			findDT := func(x parsed.DataType) bool { return alias.Name() == x.Name() }
+			if _, ok := common.Find(findDT, mod.DataTypes()); ok {
+				continue
+			}
+
+			kind := protocol.Class
+			var children []protocol.DocumentSymbol
+			nType := alias.Successor()
+			if nType != nil {
+				tType := nType.Successor()
+				switch tType.(type) {
+				case nil:
+					break
+				case *typed.TRecord:
+					kind = protocol.Struct
+					for name, f := range tType.(*typed.TRecord).Fields() {
+						children = append(children, protocol.DocumentSymbol{
+							Name:           string(name),
+							Kind:           protocol.Field,
+							Range:          locToRange(f.Location()),
+							SelectionRange: locToRange(f.Location()),
+						})
+					}
 
-				kind := protocol.Class
-				var children []protocol.DocumentSymbol
-				nType := alias.Successor()
-				if nType != nil {
-					tType := nType.Successor()
-					switch tType.(type) {
-					case nil:
-						break
-					case *typed.TRecord:
-						kind = protocol.Struct
-						for name, f := range tType.(*typed.TRecord).Fields() {
-							children = append(children, protocol.DocumentSymbol{
-								Name:           string(name),
-								Kind:           protocol.Field,
-								Range:          locToRange(f.Location()),
-								SelectionRange: locToRange(f.Location()),
-							})
-						}
-
-					case *typed.TFunc:
-						kind = protocol.Function
-					case *typed.TTuple:
-						kind = protocol.Array
-					case *typed.TNative:
-						kind = protocol.Class
-					case *typed.TUnbound:
-						kind = protocol.Null
+				case *typed.TFunc:
+					kind = protocol.Function
+				case *typed.TTuple:
+					kind = protocol.Array
+				case *typed.TNative:
+					kind = protocol.Class
+				case *typed.TUnbound:
+					kind = protocol.Null
 
-					}
-					result = append(result, protocol.DocumentSymbol{
-						Name:           string(alias.Name()),
-						Kind:           kind,
-						Range:          locToRange(alias.Location()),
-						SelectionRange: locToRange(alias.Location()),
-						Children:       children,
-					})
 				}
-			}
-			for _, dt := range mod.DataTypes() {
 				result = append(result, protocol.DocumentSymbol{
-					Name:           string(dt.Name()),
-					Kind:           protocol.Enum,
-					Range:          locToRange(dt.Location()),
-					SelectionRange: locToRange(dt.Location()),
-					Children: common.Map(func(o parsed.DataTypeOption) protocol.DocumentSymbol {
-						return protocol.DocumentSymbol{
-							Name:           string(o.Name()),
-							Kind:           protocol.EnumMember,
-							Range:          locToRange(o.Location()),
-							SelectionRange: locToRange(o.Location()),
-						}
-					}, dt.Options()),
+					Name:           string(alias.Name()),
+					Kind:           kind,
+					Range:          locToRange(alias.Location()),
+					SelectionRange: locToRange(alias.Location()),
+					Children:       children,
 				})
 			}
-			for _, d := range mod.Definitions() {
-				if unicode.IsLower([]rune(d.Name())[0]) {
-					kind := protocol.Function
-					if len(d.Params()) == 0 {
-						kind = protocol.Constant
-					}
-					if _, ok := d.Body().(*parsed.Call); ok {
-						kind = protocol.Interface
+		}
+		for _, dt := range mod.DataTypes() {
+			result = append(result, protocol.DocumentSymbol{
+				Name:           string(dt.Name()),
+				Kind:           protocol.Enum,
+				Range:          locToRange(dt.Location()),
+				SelectionRange: locToRange(dt.Location()),
+				Children: common.Map(func(o parsed.DataTypeOption) protocol.DocumentSymbol {
+					return protocol.DocumentSymbol{
+						Name:           string(o.Name()),
+						Kind:           protocol.EnumMember,
+						Range:          locToRange(o.Location()),
+						SelectionRange: locToRange(o.Location()),
 					}
-					result = append(result, protocol.DocumentSymbol{
-						Name:           string(d.Name()),
-						Kind:           kind,
-						Range:          locToRange(d.Location()),
-						SelectionRange: locToRange(d.Location()),
-					})
+				}, dt.Options()),
+			})
+		}
+		for _, d := range mod.Definitions() {
+			if unicode.IsLower([]rune(d.Name())[0]) {
+				kind := protocol.Function
+				if len(d.Params()) == 0 {
+					kind = protocol.Constant
+				}
+				if _, ok := d.Body().(*parsed.Call); ok {
+					kind = protocol.Interface
 				}
+				result = append(result, protocol.DocumentSymbol{
+					Name:           string(d.Name()),
+					Kind:           kind,
+					Range:          locToRange(d.Location()),
+					SelectionRange: locToRange(d.Location()),
+				})
 			}
-			break
 		}
 	}
 	return
@@ -405,336 +386,77 @@ func (s *server) TextDocument_documentSymbol(
 func (s *server) TextDocument_semanticTokens_full(
 	params *protocol.SemanticTokensParams,
 ) (*protocol.SemanticTokens, error) {
-	if len(s.parsedModules) == 0 {
-		<-s.compiledChan
-	}
-	path := uriToPath(params.TextDocument.URI)
-	for _, mod := range s.parsedModules {
-		if mod.Location().FilePath() == path {
-			var tokens []ast.SemanticToken
-			mod.Iterate(func(stmt parsed.Statement) {
-				tokens = append(tokens, stmt.SemanticTokens()...)
-			})
-			slices.SortFunc(tokens, func(a, b ast.SemanticToken) int {
-				if a.Line < b.Line {
-					return -1
-				}
-				if a.Line > b.Line {
-					return 1
-				}
-				if a.Char < b.Char {
-					return -1
-				}
-				if a.Char > b.Char {
-					return 1
-				}
-				return 0
-			})
+	return s.fullSemanticTokens(params.TextDocument.URI), nil
+}
 
-			deltas := make([]ast.SemanticToken, 0, len(tokens))
-			if len(tokens) > 0 {
-				deltas = append(deltas, tokens[0])
-				for i := 1; i < len(tokens); i++ {
-					p := tokens[i-1]
-					t := tokens[i]
-					dl := t.Line - p.Line
-					if dl == 0 {
-						t.Line = 0
-						t.Char = t.Char - p.Char
-					} else {
-						t.Line = dl
-					}
-					deltas = append(deltas, t)
-				}
-			}
+func (s *server) TextDocument_semanticTokens_full_delta(
+	params *protocol.SemanticTokensDeltaParams,
+) (any, error) {
+	return s.semanticTokensDelta(params.TextDocument.URI, params.PreviousResultID), nil
+}
 
-			return &protocol.SemanticTokens{
-				Data: common.Fold(
-					func(t ast.SemanticToken, acc []uint32) []uint32 {
-						return append(acc, t.Line, t.Char, t.Length, uint32(t.Type), uint32(t.Modifiers))
-					}, nil, deltas),
-			}, nil
-		}
-	}
-	return nil, nil
+func (s *server) TextDocument_semanticTokens_range(
+	params *protocol.SemanticTokensRangeParams,
+) (*protocol.SemanticTokens, error) {
+	return s.rangeSemanticTokens(params.TextDocument.URI, params.Range), nil
+}
+
+func (s *server) TextDocument_diagnostic(
+	params *protocol.DocumentDiagnosticParams,
+) (protocol.DocumentDiagnosticReport, error) {
+	return s.documentDiagnostic(params.TextDocument.URI, params.PreviousResultID), nil
+}
+
+func (s *server) Workspace_diagnostic(
+	params *protocol.WorkspaceDiagnosticParams,
+) (protocol.WorkspaceDiagnosticReport, error) {
+	return s.workspaceDiagnostic(params.PreviousResultIds), nil
 }
 
 var keywordCompletions []protocol.CompletionItem
 
 func init() {
 	keywordCompletions = common.Map(func(k string) protocol.CompletionItem {
-		return protocol.CompletionItem{
+		item := protocol.CompletionItem{
 			Label: k,
 			Kind:  protocol.KeywordCompletion,
 		}
+		if snippet, ok := keywordSnippets[k]; ok {
+			format := protocol.SnippetTextFormat
+			item.InsertText = snippet
+			item.InsertTextFormat = &format
+		}
+		return item
 	}, nar_compiler.Keywords)
 }
 
 func (s *server) TextDocument_completion(
 	params *protocol.CompletionParams,
 ) (*protocol.CompletionList, error) {
-	localItems := map[ast.Identifier]struct{}{}
-	var appendLocals func(locals ...normalized.Pattern)
-	appendLocals = func(locals ...normalized.Pattern) {
-		for _, p := range locals {
-			switch p.(type) {
-			case *normalized.PAlias:
-				localItems[p.(*normalized.PAlias).Alias()] = struct{}{}
-				appendLocals(p.(*normalized.PAlias).Nested())
-			case *normalized.PCons:
-				appendLocals(p.(*normalized.PCons).Head(), p.(*normalized.PCons).Tail())
-			case *normalized.PList:
-				appendLocals(p.(*normalized.PList).Items()...)
-			case *normalized.PNamed:
-				localItems[p.(*normalized.PNamed).Name()] = struct{}{}
-			case *normalized.POption:
-				appendLocals(p.(*normalized.POption).Values()...)
-			case *normalized.PRecord:
-				for _, f := range p.(*normalized.PRecord).Fields() {
-					localItems[f.Name()] = struct{}{}
-				}
-			case *normalized.PTuple:
-				appendLocals(p.(*normalized.PTuple).Items()...)
-			}
-		}
-	}
-
-	loc, module, ok := s.locationUnderCursor(params.TextDocument.URI, params.Position.Line, params.Position.Character)
-	if module == nil {
+	items := s.completion(params.TextDocument.URI, params.Position)
+	if items == nil {
 		return nil, nil
 	}
-	if ok {
-		module.Iterate(func(stmt parsed.Statement) {
-			if stmt.Location().Contains(loc) {
-				nStmt := stmt.Successor()
-				switch nStmt.(type) {
-				case normalized.Definition:
-					appendLocals(nStmt.(normalized.Definition).Params()...)
-				case *normalized.Let:
-					appendLocals(nStmt.(*normalized.Let).Pattern())
-				case *normalized.Select:
-					for _, cs := range nStmt.(*normalized.Select).Cases() {
-						if cs.Location().Contains(loc) {
-							appendLocals(cs.Pattern())
-						}
-					}
-				}
-			}
-		})
-	}
-
-	var completions []protocol.CompletionItem
-	for _, m := range s.parsedModules {
-		if m != nil {
-			fullName := m.Name()
-			shortName := ast.QualifiedIdentifier("")
-			alias := ast.Identifier("")
-
-			for _, imp := range module.Imports() {
-				if imp.Module() == m.Name() {
-					if imp.Alias() != nil {
-						alias = *imp.Alias()
-					}
-				}
-			}
-
-			isCurrentModule := m == module
-			lastDotIndex := strings.LastIndex(string(fullName), ".")
-			if lastDotIndex >= 0 {
-				shortName = fullName[lastDotIndex+1:]
-			}
-
-			addName := func(name ast.Identifier, kind protocol.CompletionItemKind) {
-				completions = append(completions, protocol.CompletionItem{
-					Label: string(name), //TODO: do not insert ambiguous names
-					Kind:  kind,
-					LabelDetails: &protocol.CompletionItemLabelDetails{
-						Detail: fmt.Sprintf(" %s.%s", fullName, name),
-					},
-				})
-				completions = append(completions,
-					protocol.CompletionItem{
-						Label: fmt.Sprintf("%s.%s", fullName, name),
-						Kind:  kind,
-						LabelDetails: &protocol.CompletionItemLabelDetails{
-							Detail: fmt.Sprintf(" %s.%s", fullName, name),
-						},
-					})
-				if alias != "" {
-					completions = append(completions,
-						protocol.CompletionItem{
-							Label: fmt.Sprintf("%s.%s", alias, name),
-							Kind:  kind,
-							LabelDetails: &protocol.CompletionItemLabelDetails{
-								Detail: fmt.Sprintf(" %s.%s", fullName, name),
-							},
-						})
-				} else if shortName != "" {
-					completions = append(completions,
-						protocol.CompletionItem{
-							Label: fmt.Sprintf("%s.%s", shortName, name),
-							Kind:  kind,
-							LabelDetails: &protocol.CompletionItemLabelDetails{
-								Detail: fmt.Sprintf(" %s.%s", fullName, name),
-							},
-						})
-				}
-			}
-
-			for _, def := range m.Definitions() {
-				if isCurrentModule || !def.Hidden() {
-					kind := protocol.FunctionCompletion
-					if len(def.Params()) == 0 {
-						kind = protocol.ConstantCompletion
-					}
-					addName(def.Name(), kind)
-				}
-			}
-			for _, alias := range m.Aliases() {
-				if isCurrentModule || !alias.Hidden() {
-					addName(alias.Name(), protocol.ClassCompletion)
-				}
-			}
-			for _, dt := range m.DataTypes() {
-				if isCurrentModule || !dt.Hidden() {
-					addName(dt.Name(), protocol.EnumCompletion)
-					for _, opt := range dt.Options() {
-						if isCurrentModule || !opt.Hidden() {
-							addName(opt.Name(), protocol.EnumMemberCompletion)
-						}
-					}
-				}
-			}
-			for _, ifx := range m.InfixFns() {
-				completions = append(completions,
-					protocol.CompletionItem{
-						Label: string(ifx.Name()),
-						Kind:  protocol.OperatorCompletion,
-					})
-			}
+	if !s.snippetSupport {
+		for i := range items {
+			items[i].InsertText = ""
+			items[i].InsertTextFormat = nil
 		}
 	}
+	return &protocol.CompletionList{IsIncomplete: false, Items: items}, nil
+}
 
-	list := append(
-		common.Map(func(i ast.Identifier) protocol.CompletionItem {
-			return protocol.CompletionItem{
-				Label: string(i),
-				Kind:  protocol.VariableCompletion,
-			}
-		}, common.Keys(localItems)),
-		completions...)
-	list = append(list, keywordCompletions...)
-
-	return &protocol.CompletionList{IsIncomplete: false, Items: list}, nil
+func (s *server) CompletionItem_resolve(params *protocol.CompletionItem) (*protocol.CompletionItem, error) {
+	if id, ok := params.Data.(string); ok {
+		s.resolveCompletion(params, ast.FullIdentifier(id))
+	}
+	return params, nil
 }
 
 func (s *server) TextDocument_signatureHelp(
 	params *protocol.SignatureHelpParams,
 ) (*protocol.SignatureHelp, error) {
-
-	extractSignature := func(loc ast.Location) *protocol.SignatureHelp {
-		str := loc.Text()
-		eq := strings.Index(str, "=")
-		if eq >= 0 {
-			str = str[:eq]
-		}
-		return &protocol.SignatureHelp{
-			Signatures: []protocol.SignatureInformation{
-				{
-					Label: str,
-				},
-			},
-		}
-	}
-
-	extractSignatureFromDef := func(modName ast.QualifiedIdentifier, defName ast.Identifier) *protocol.SignatureHelp {
-		if defMod, ok := s.parsedModules[modName]; ok {
-			def, ok := common.Find(func(d parsed.Definition) bool { return d.Name() == defName }, defMod.Definitions())
-			if ok {
-				return extractSignature(def.Location())
-			}
-		}
-		return nil
-	}
-
-	var signature *protocol.SignatureHelp
-	if loc, m, ok := s.locationUnderCursor(params.TextDocument.URI, params.Position.Line, params.Position.Character); ok {
-		m.Iterate(func(stmt parsed.Statement) {
-			if stmt.Location().Contains(loc) {
-				nStmt := stmt.Successor()
-				switch nStmt.(type) {
-				case *normalized.Apply:
-					apply := nStmt.(*normalized.Apply)
-					switch apply.Func().(type) {
-					case *normalized.Global:
-						signature = extractSignatureFromDef(apply.Func().(*normalized.Global).DefinitionName())
-					case *normalized.Local:
-						local := apply.Func().(*normalized.Local).Target()
-						signature = extractSignature(local.Location())
-					}
-				case *normalized.POption:
-					signature = extractSignatureFromDef(nStmt.(*normalized.POption).DefinitionName())
-				}
-			}
-		})
-
-		if signature == nil {
-			text := loc.FileContent()
-			end := loc.Start()
-			for end > 0 && text[end] != '(' {
-				end--
-			}
-			if end < 0 {
-				start := end - 1
-				for start > 0 && isIdentChar(text[start]) {
-					start--
-				}
-				if !isIdentChar(text[start]) {
-					start++
-				}
-
-				if end-start > 0 && start > 0 {
-					ident := text[start:end]
-					if def, defMod, _ := m.FindDefinition(s.parsedModules, ast.QualifiedIdentifier(ident)); def != nil {
-						if nDef := def.Successor(); nDef != nil {
-							if tDef := nDef.Successor(); tDef != nil {
-								label := strings.Builder{}
-								label.WriteString(string(common.MakeFullIdentifier(defMod.Name(), def.Name())))
-								label.WriteString("(\n")
-								for _, x := range tDef.Children() {
-									if p, ok := x.(typed.Pattern); ok {
-										label.WriteString("\t")
-										label.WriteString(p.Code(defMod.Name()))
-										label.WriteString("\n")
-									}
-								}
-								label.WriteString(") : ")
-								label.WriteString(tDef.(*typed.Definition).DeclaredType().(*typed.TFunc).Return().Code(defMod.Name()))
-								var parameters []protocol.ParameterInformation
-								for _, x := range tDef.Children() {
-									if p, ok := x.(typed.Pattern); ok {
-										parameters = append(parameters, protocol.ParameterInformation{
-											Label: p.Code(defMod.Name()),
-										})
-									}
-								}
-								signature = &protocol.SignatureHelp{
-									Signatures: []protocol.SignatureInformation{
-										{
-											Documentation: &protocol.Or_SignatureInformation_documentation{
-												Value: label.String(),
-											},
-										},
-									},
-								}
-							}
-						}
-					}
-				}
-			}
-		}
-	}
-	return signature, nil
+	return s.signatureHelp(params.TextDocument.URI, params.Position), nil
 }
 
 func isIdentChar(c rune) bool {
@@ -750,130 +472,76 @@ func isIdentChar(c rune) bool {
 	return false
 }
 
+func (s *server) TextDocument_prepareRename(
+	params *protocol.PrepareRenameParams,
+) (*protocol.PrepareRenameResult, error) {
+	return s.prepareRename(params.TextDocument.URI, params.Position)
+}
+
 func (s *server) TextDocument_rename(
 	params *protocol.RenameParams,
 ) (*protocol.WorkspaceEdit, error) {
-	loc, mod, ok := s.locationUnderCursor(params.TextDocument.URI, params.Position.Line, params.Position.Character)
-	result := &protocol.WorkspaceEdit{
-		Changes: map[protocol.DocumentURI][]protocol.TextEdit{},
-	}
-	appendDefinition := func(def *typed.Definition) {
-		if def != nil {
-			result.Changes[pathToUri(def.Location().FilePath())] = append(
-				result.Changes[pathToUri(def.Location().FilePath())],
-				protocol.TextEdit{
-					Range:   locToRange(def.NameLocation()),
-					NewText: params.NewName,
-				})
-			for _, m := range s.parsedModules {
-				m.Iterate(func(e parsed.Statement) {
-					nStmt := e.Successor()
-					if nStmt != nil {
-						if g, ok := nStmt.Successor().(*typed.Global); ok {
-							if g.Definition().Id() == def.Id() {
-								result.Changes[pathToUri(def.Location().FilePath())] = append(
-									result.Changes[pathToUri(def.Location().FilePath())],
-									protocol.TextEdit{
-										Range:   locToRange(e.Location()),
-										NewText: params.NewName,
-									})
-							}
-						}
-					}
-				})
-			}
-		}
-	}
-	appendPattern := func(pattern typed.Pattern) {
-		if pattern != nil {
-			result.Changes[pathToUri(pattern.Location().FilePath())] = append(
-				result.Changes[pathToUri(pattern.Location().FilePath())],
-				protocol.TextEdit{
-					Range:   locToRange(pattern.Location()),
-					NewText: params.NewName,
-				})
-			for _, m := range s.parsedModules {
-				if pattern.Location().FilePath() == m.Location().FilePath() {
-					m.Iterate(func(stmt parsed.Statement) {
-						nStmt := stmt.Successor()
-						if nStmt != nil {
-							tStmt := nStmt.Successor()
-							if l, ok := tStmt.(*typed.Local); ok {
-								if l.Target() == pattern {
-									result.Changes[pathToUri(pattern.Location().FilePath())] = append(
-										result.Changes[pathToUri(pattern.Location().FilePath())],
-										protocol.TextEdit{
-											Range:   locToRange(stmt.Location()),
-											NewText: params.NewName,
-										})
-								}
-							}
-						}
-					})
-				}
-			}
-		}
+	return s.rename(params.TextDocument.URI, params.Position, params.NewName)
+}
+
+func (s *server) TextDocument_codeLens(params *protocol.CodeLensParams) ([]protocol.CodeLens, error) {
+	if mod := s.moduleOfPath(uriToPath(params.TextDocument.URI)); mod != nil {
+		return s.codeLenses(params.TextDocument.URI, mod), nil
 	}
+	return nil, nil
+}
 
-	appendType := func(t typed.Type) {
-		if t != nil {
+func (s *server) Workspace_executeCommand(params *protocol.ExecuteCommandParams) (any, error) {
+	return nil, s.executeCommand(params)
+}
 
-			result.Changes[pathToUri(t.Location().FilePath())] = append(
-				result.Changes[pathToUri(t.Location().FilePath())],
-				protocol.TextEdit{
-					Range:   locToRange(t.Location()),
-					NewText: params.NewName,
-				})
-			for _, m := range s.parsedModules {
-				m.Iterate(func(stmt parsed.Statement) {
-					nStmt := stmt.Successor()
-					if nStmt != nil {
-						if p, ok := nStmt.Successor().(typed.Pattern); ok {
-							if p.DeclaredType().EqualsTo(t, nil) {
-								result.Changes[pathToUri(t.Location().FilePath())] = append(
-									result.Changes[pathToUri(t.Location().FilePath())],
-									protocol.TextEdit{
-										Range:   locToRange(p.Type().Location()),
-										NewText: params.NewName,
-									})
-							}
-						}
-					}
-				})
-			}
-		}
+func (s *server) TextDocument_foldingRange(params *protocol.FoldingRangeParams) ([]protocol.FoldingRange, error) {
+	if mod := s.moduleOfPath(uriToPath(params.TextDocument.URI)); mod != nil {
+		return foldingRanges(mod), nil
 	}
+	return nil, nil
+}
 
-	if ok {
-		_, _, tStmt := s.statementAtLocation(loc, mod)
-		if tStmt != nil {
-			switch tStmt.(type) {
-			case *typed.Global:
-				def := tStmt.(*typed.Global).Definition()
-				if def != nil {
-					appendDefinition(def)
-				}
-				break
-			case *typed.Local:
-				target := tStmt.(*typed.Local).Target()
-				if target != nil {
-					appendPattern(target)
-				}
-			case *typed.Definition:
-				def := tStmt.(*typed.Definition)
-				appendDefinition(def)
-				break
-			case typed.Pattern:
-				pattern := tStmt.(typed.Pattern)
-				appendPattern(pattern)
-				break
-			case typed.Type:
-				type_ := tStmt.(typed.Type)
-				appendType(type_)
-				break
-			}
-
+func (s *server) TextDocument_selectionRange(params *protocol.SelectionRangeParams) ([]protocol.SelectionRange, error) {
+	var result []protocol.SelectionRange
+	for _, pos := range params.Positions {
+		loc, m, ok := s.locationUnderCursor(params.TextDocument.URI, pos.Line, pos.Character)
+		if !ok {
+			return nil, nil
 		}
+		result = append(result, selectionRanges(loc, m))
 	}
 	return result, nil
 }
+
+func (s *server) TextDocument_prepareCallHierarchy(
+	params *protocol.CallHierarchyPrepareParams,
+) ([]protocol.CallHierarchyItem, error) {
+	return s.prepareCallHierarchy(params.TextDocument.URI, params.Position), nil
+}
+
+func (s *server) CallHierarchy_incomingCalls(
+	params *protocol.CallHierarchyIncomingCallsParams,
+) ([]protocol.CallHierarchyIncomingCall, error) {
+	return s.incomingCalls(params.Item), nil
+}
+
+func (s *server) CallHierarchy_outgoingCalls(
+	params *protocol.CallHierarchyOutgoingCallsParams,
+) ([]protocol.CallHierarchyOutgoingCall, error) {
+	return s.outgoingCalls(params.Item), nil
+}
+
+func (s *server) Workspace_didChangeWatchedFiles(params *protocol.DidChangeWatchedFilesParams) error {
+	s.watchedFilesChanged(params.Changes)
+	return nil
+}
+
+func (s *server) Workspace_didChangeWorkspaceFolders(params *protocol.DidChangeWorkspaceFoldersParams) error {
+	s.changeWorkspaceFolders(params.Event)
+	return nil
+}
+
+func (s *server) Workspace_willRenameFiles(params *protocol.RenameFilesParams) (*protocol.WorkspaceEdit, error) {
+	return s.willRenameFiles(params.Files), nil
+}
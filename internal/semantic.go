@@ -0,0 +1,238 @@
+package internal
+
+import (
+	"fmt"
+	"github.com/nar-lang/nar-compiler"
+	"github.com/nar-lang/nar-compiler/ast"
+	"github.com/nar-lang/nar-compiler/ast/parsed"
+	"github.com/nar-lang/nar-compiler/ast/typed"
+	"github.com/nar/internal/protocol"
+	"os"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// modifiers that are not defined by the compiler, bits follow ast.SemanticTokenModifiersLegend
+const (
+	tokenModifierHidden ast.SemanticTokenModifier = 0x400
+	tokenModifierNative ast.SemanticTokenModifier = 0x800
+)
+
+var semanticTokenModifiersLegend = append(slices.Clone(ast.SemanticTokenModifiersLegend), "hidden", "native")
+
+// semanticTokensResult is the last result sent to the client for the document, delta requests are computed against it
+type semanticTokensResult struct {
+	id   string
+	data []uint32
+}
+
+// semanticTokens returns tokens of the compiled module or falls back to tokens of the parsed
+// document text while the module is not compiled yet or the document is changed after compilation
+func (s *server) semanticTokens(uri protocol.DocumentURI) ([]ast.SemanticToken, bool) {
+	path := uriToPath(uri)
+	text, ok := s.sourceText(uri)
+	if !ok {
+		return nil, false
+	}
+	// offsets of the compiled module can be used only if its text matches the document
+	mod := s.moduleOfPath(path)
+	if mod == nil || !slices.Equal(text, mod.Location().FileContent()) {
+		if mod, _ = nar_compiler.Parse(path, text); mod == nil {
+			return nil, false
+		}
+	}
+	var tokens []ast.SemanticToken
+	mod.Iterate(func(stmt parsed.Statement) {
+		if stmt != nil {
+			tokens = append(tokens, s.refineSemanticTokens(stmt, mod.Name(), stmt.SemanticTokens())...)
+		}
+	})
+	slices.SortFunc(tokens, func(a, b ast.SemanticToken) int {
+		if a.Line != b.Line {
+			return int(a.Line) - int(b.Line)
+		}
+		return int(a.Char) - int(b.Char)
+	})
+	return tokens, true
+}
+
+// refineSemanticTokens adds modifiers and token types that parser cannot know about
+// using definitions the statement refers to
+func (s *server) refineSemanticTokens(
+	stmt parsed.Statement, moduleName ast.QualifiedIdentifier, tokens []ast.SemanticToken,
+) []ast.SemanticToken {
+	if len(tokens) == 0 {
+		return tokens
+	}
+	if def, ok := stmt.(parsed.Definition); ok {
+		var tDef *typed.Definition
+		if nDef := def.Successor(); nDef != nil {
+			tDef, _ = nDef.Successor().(*typed.Definition)
+		}
+		tokens[0].Modifiers |= ast.TokenModifierDeclaration | definitionModifiers(moduleName, def.Hidden(), tDef)
+		return tokens
+	}
+	nStmt := stmt.Successor()
+	if nStmt == nil {
+		return tokens
+	}
+	switch e := nStmt.Successor().(type) {
+	case *typed.Global:
+		if def := e.Definition(); def != nil {
+			if id, ok := s.definitionIdentifier(def); ok {
+				pDef, _ := s.parsedDefinition(id)
+				hidden := pDef != nil && pDef.Hidden()
+				tokens[0].Modifiers |= definitionModifiers(ast.QualifiedIdentifier(id[:len(id)-len(def.Name())-1]), hidden, def)
+			}
+			if unicode.IsLower([]rune(def.Name())[0]) && len(def.Params()) > 0 {
+				tokens[0].Type = ast.TokenTypeFunction
+			}
+		}
+	case *typed.Local:
+		// locals never share modifiers of definitions even if they have the same name
+		tokens[0].Type = ast.TokenTypeVariable
+		tokens[0].Modifiers = 0
+	case *typed.POption:
+		if def := e.Definition(); def != nil {
+			if id, ok := s.definitionIdentifier(def); ok && isDefaultLibraryName(string(id)) {
+				tokens[0].Modifiers |= ast.TokenModifierDefaultLibrary
+			}
+		}
+	case *typed.TData:
+		if isDefaultLibraryName(string(e.Name())) {
+			tokens[0].Modifiers |= ast.TokenModifierDefaultLibrary
+		}
+	case *typed.TNative:
+		if isDefaultLibraryName(string(e.Name())) {
+			tokens[0].Modifiers |= ast.TokenModifierDefaultLibrary
+		}
+	}
+	return tokens
+}
+
+// definitionModifiers returns modifiers describing the top level definition. Typed definition does not
+// expose visibility, so hidden is taken from the parsed one. Def is nil until the module is compiled.
+func definitionModifiers(moduleName ast.QualifiedIdentifier, hidden bool, def *typed.Definition) ast.SemanticTokenModifier {
+	var modifiers ast.SemanticTokenModifier
+	if hidden {
+		modifiers |= tokenModifierHidden
+	}
+	if def != nil {
+		if _, native := def.Body().(*typed.Call); native {
+			modifiers |= tokenModifierNative
+		}
+		if _, constant := def.Body().(*typed.Const); constant && len(def.Params()) == 0 {
+			modifiers |= ast.TokenModifierReadonly
+		}
+	}
+	if isDefaultLibraryName(string(moduleName)) {
+		modifiers |= ast.TokenModifierDefaultLibrary
+	}
+	return modifiers
+}
+
+func isDefaultLibraryName(name string) bool {
+	return name == "Nar.Base" || strings.HasPrefix(name, "Nar.Base.")
+}
+
+// sourceText returns content of the opened document or reads the file
+func (s *server) sourceText(uri protocol.DocumentURI) ([]rune, bool) {
+	if pvd, ok := s.getProvider(uri); ok {
+		if text, ok := pvd.overrides[uriToPath(uri)]; ok {
+			return text, true
+		}
+	}
+	data, err := os.ReadFile(uriToPath(uri))
+	if err != nil {
+		return nil, false
+	}
+	return []rune(string(data)), true
+}
+
+// encodeSemanticTokens encodes sorted tokens relative to the previous ones
+func encodeSemanticTokens(tokens []ast.SemanticToken) []uint32 {
+	data := make([]uint32, 0, len(tokens)*5)
+	var prevLine, prevChar uint32
+	for _, t := range tokens {
+		line, char := t.Line-prevLine, t.Char
+		if line == 0 {
+			char = t.Char - prevChar
+		}
+		data = append(data, line, char, t.Length, uint32(t.Type), uint32(t.Modifiers))
+		prevLine, prevChar = t.Line, t.Char
+	}
+	return data
+}
+
+// fullSemanticTokens returns tokens of the whole document and remembers them for delta requests
+func (s *server) fullSemanticTokens(uri protocol.DocumentURI) *protocol.SemanticTokens {
+	tokens, ok := s.semanticTokens(uri)
+	if !ok {
+		return nil
+	}
+	data := encodeSemanticTokens(tokens)
+
+	s.locker.Lock()
+	s.lastSemanticTokensId++
+	result := semanticTokensResult{
+		id:   fmt.Sprintf("%d", s.lastSemanticTokensId),
+		data: data,
+	}
+	s.semanticTokensResults[uri] = result
+	s.locker.Unlock()
+
+	return &protocol.SemanticTokens{ResultID: result.id, Data: result.data}
+}
+
+// semanticTokensDelta returns a single edit that transforms the previous result into the current one
+// or the full result if the previous one is unknown
+func (s *server) semanticTokensDelta(uri protocol.DocumentURI, previousId string) any {
+	s.locker.Lock()
+	previous, ok := s.semanticTokensResults[uri]
+	s.locker.Unlock()
+
+	full := s.fullSemanticTokens(uri)
+	if full == nil {
+		return nil
+	}
+	if !ok || previous.id != previousId {
+		return full
+	}
+	return &protocol.SemanticTokensDelta{ResultID: full.ResultID, Edits: semanticTokensEdits(previous.data, full.Data)}
+}
+
+// semanticTokensEdits returns a single edit replacing the part between common prefix and suffix
+// of encoded tokens or no edits if they are equal
+func semanticTokensEdits(previous []uint32, current []uint32) []protocol.SemanticTokensEdit {
+	prefix := 0
+	for prefix < len(previous) && prefix < len(current) && previous[prefix] == current[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(previous)-prefix && suffix < len(current)-prefix &&
+		previous[len(previous)-1-suffix] == current[len(current)-1-suffix] {
+		suffix++
+	}
+	edits := []protocol.SemanticTokensEdit{}
+	if prefix+suffix < len(previous) || prefix+suffix < len(current) {
+		edits = append(edits, protocol.SemanticTokensEdit{
+			Start:       uint32(prefix),
+			DeleteCount: uint32(len(previous) - prefix - suffix),
+			Data:        current[prefix : len(current)-suffix],
+		})
+	}
+	return edits
+}
+
+// rangeSemanticTokens returns tokens of lines in the range
+func (s *server) rangeSemanticTokens(uri protocol.DocumentURI, r protocol.Range) *protocol.SemanticTokens {
+	tokens, ok := s.semanticTokens(uri)
+	if !ok {
+		return nil
+	}
+	tokens = slices.DeleteFunc(tokens, func(t ast.SemanticToken) bool {
+		return t.Line < r.Start.Line || t.Line > r.End.Line
+	})
+	return &protocol.SemanticTokens{Data: encodeSemanticTokens(tokens)}
+}
@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"github.com/nar/internal/protocol"
+	"slices"
+	"testing"
+)
+
+func TestSemanticTokensEdits(t *testing.T) {
+	tests := []struct {
+		name     string
+		previous []uint32
+		current  []uint32
+		// edit is nil if tokens are equal
+		edit *protocol.SemanticTokensEdit
+	}{
+		{name: "equal", previous: []uint32{1, 2, 3}, current: []uint32{1, 2, 3}},
+		{name: "both empty"},
+		{
+			name:    "from empty",
+			current: []uint32{1, 2, 3},
+			edit:    &protocol.SemanticTokensEdit{Start: 0, DeleteCount: 0, Data: []uint32{1, 2, 3}},
+		},
+		{
+			name:     "to empty",
+			previous: []uint32{1, 2, 3},
+			edit:     &protocol.SemanticTokensEdit{Start: 0, DeleteCount: 3},
+		},
+		{
+			name:     "changed in the middle",
+			previous: []uint32{1, 2, 3, 4, 5},
+			current:  []uint32{1, 2, 9, 4, 5},
+			edit:     &protocol.SemanticTokensEdit{Start: 2, DeleteCount: 1, Data: []uint32{9}},
+		},
+		{
+			name:     "inserted at the start",
+			previous: []uint32{1, 2},
+			current:  []uint32{0, 1, 2},
+			edit:     &protocol.SemanticTokensEdit{Start: 0, DeleteCount: 0, Data: []uint32{0}},
+		},
+		{
+			name:     "appended",
+			previous: []uint32{1, 2},
+			current:  []uint32{1, 2, 3, 4},
+			edit:     &protocol.SemanticTokensEdit{Start: 2, DeleteCount: 0, Data: []uint32{3, 4}},
+		},
+		{
+			name:     "removed in the middle",
+			previous: []uint32{1, 2, 3, 4, 5},
+			current:  []uint32{1, 5},
+			edit:     &protocol.SemanticTokensEdit{Start: 1, DeleteCount: 3},
+		},
+		{
+			name:     "prefix and suffix overlap",
+			previous: []uint32{0, 0, 0},
+			current:  []uint32{0, 0, 0, 0},
+			edit:     &protocol.SemanticTokensEdit{Start: 3, DeleteCount: 0, Data: []uint32{0}},
+		},
+		{
+			name:     "replaced completely",
+			previous: []uint32{1, 2, 3},
+			current:  []uint32{4, 5},
+			edit:     &protocol.SemanticTokensEdit{Start: 0, DeleteCount: 3, Data: []uint32{4, 5}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			edits := semanticTokensEdits(tt.previous, tt.current)
+			if tt.edit == nil {
+				if len(edits) != 0 {
+					t.Errorf("edits are %+v, expected none", edits)
+				}
+				return
+			}
+			if len(edits) != 1 {
+				t.Fatalf("edits are %+v, expected %+v", edits, *tt.edit)
+			}
+			e := edits[0]
+			if e.Start != tt.edit.Start || e.DeleteCount != tt.edit.DeleteCount || !slices.Equal(e.Data, tt.edit.Data) {
+				t.Errorf("edit is %+v, expected %+v", e, *tt.edit)
+			}
+			// edit applied to the previous tokens gives the current ones
+			applied := append(append(slices.Clone(tt.previous[:e.Start]), e.Data...), tt.previous[e.Start+e.DeleteCount:]...)
+			if !slices.Equal(applied, tt.current) {
+				t.Errorf("edit gives %v, expected %v", applied, tt.current)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package internal
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/nar-lang/nar-compiler/ast"
 	"github.com/nar-lang/nar-compiler/ast/normalized"
@@ -17,35 +18,56 @@ import (
 	"runtime/debug"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const Version uint32 = 100
 
+// responseTimeout limits waiting for responses to requests sent by the server
+const responseTimeout = 10 * time.Second
+
 type server struct {
 	id        int
 	log       *logger.LogWriter
 	trace     protocol.TraceValues
 	cancelCtx context.CancelFunc
 
-	rootURI          protocol.DocumentURI
-	initialized      bool
-	responseChan     chan rpcResponse
-	notificationChan chan rpcNotification
-	inChan           chan []byte
-	compileChan      chan docChange
-	compiledChan     chan struct{}
-	locker           sync.Locker
+	rootURI                   protocol.DocumentURI
+	initialized               bool
+	snippetSupport            bool
+	progressSupport           bool
+	pullDiagnostics           bool
+	diagnosticsRefreshSupport bool
+	semanticTokensRefresh     bool
+	watchFilesSupport         bool
+	responseChan              chan rpcResponse
+	notificationChan          chan rpcNotification
+	requestChan               chan rpcCall
+	lastRequestId             atomic.Uint32
+	responseWaiters           map[uint32]chan rpcResponse
+	inChan                    chan []byte
+	compileChan               chan docChange
+	locker                    sync.Locker
 
 	documentToPackageRoot map[protocol.DocumentURI]string
 	packageRootToName     map[string]ast.PackageIdentifier
 	locator               locator.Locator
 	provides              map[string]*provider
+	cacheDir              string
 	cacheProvider         locator.Provider
 	workspaceProviders    []locator.Provider
+	workspaceFolders      []string
 	parsedModules         map[ast.QualifiedIdentifier]*parsed.Module
 	normalizedModules     map[ast.QualifiedIdentifier]*normalized.Module
 	typedModules          map[ast.QualifiedIdentifier]*typed.Module
+	index                 *referenceIndex
 	openedDocuments       map[protocol.DocumentURI]struct{}
+	documentVersions      map[protocol.DocumentURI]int32
+	semanticTokensResults map[protocol.DocumentURI]semanticTokensResult
+	lastSemanticTokensId  uint64
+	diagnostics           map[protocol.DocumentURI]diagnosticReport
+	lastDiagnosticsId     uint64
 }
 
 type docChange struct {
@@ -69,11 +91,13 @@ func NewServer(cacheDir string, writeResponse func([]byte)) LanguageServer {
 		inChan:           make(chan []byte, 16),
 		responseChan:     make(chan rpcResponse, 16),
 		notificationChan: make(chan rpcNotification, 128),
+		requestChan:      make(chan rpcCall, 16),
 		compileChan:      make(chan docChange, 1024),
-		compiledChan:     make(chan struct{}),
 		locker:           &sync.Mutex{},
+		responseWaiters:  map[uint32]chan rpcResponse{},
 
 		log:                   &logger.LogWriter{},
+		cacheDir:              cacheDir,
 		cacheProvider:         locator.NewDirectoryProvider(cacheDir),
 		documentToPackageRoot: map[protocol.DocumentURI]string{},
 		packageRootToName:     map[string]ast.PackageIdentifier{},
@@ -81,7 +105,11 @@ func NewServer(cacheDir string, writeResponse func([]byte)) LanguageServer {
 		parsedModules:         map[ast.QualifiedIdentifier]*parsed.Module{},
 		normalizedModules:     map[ast.QualifiedIdentifier]*normalized.Module{},
 		typedModules:          map[ast.QualifiedIdentifier]*typed.Module{},
+		index:                 newReferenceIndex(),
 		openedDocuments:       map[protocol.DocumentURI]struct{}{},
+		documentVersions:      map[protocol.DocumentURI]int32{},
+		semanticTokensResults: map[protocol.DocumentURI]semanticTokensResult{},
+		diagnostics:           map[protocol.DocumentURI]diagnosticReport{},
 	}
 	go s.sender(writeResponse, ctx)
 	go s.receiver(ctx)
@@ -92,6 +120,7 @@ func (s *server) Close() {
 	s.cancelCtx()
 	close(s.responseChan)
 	close(s.notificationChan)
+	close(s.requestChan)
 	close(s.inChan)
 	close(s.compileChan)
 }
@@ -125,6 +154,9 @@ func (s *server) sender(writeResponse func([]byte), ctx context.Context) {
 		case notification := <-s.notificationChan:
 			data, err = json.Marshal(notification)
 			break
+		case request := <-s.requestChan:
+			data, err = json.Marshal(request)
+			break
 		case <-ctx.Done():
 			return
 		}
@@ -149,6 +181,22 @@ func (s *server) handleMessage(msg []byte) error {
 		return err
 	}
 
+	if call.Method == "" {
+		// response to a request sent by the server, only some of them are awaited
+		var response rpcResponse
+		if err := json.Unmarshal(msg, &response); err != nil {
+			return err
+		}
+		s.locker.Lock()
+		waiter, ok := s.responseWaiters[response.Id]
+		delete(s.responseWaiters, response.Id)
+		s.locker.Unlock()
+		if ok {
+			waiter <- response
+		}
+		return nil
+	}
+
 	println("<- " + call.Method)
 
 	response := rpcResponse{
@@ -189,9 +237,14 @@ func (s *server) handleMessage(msg []byte) error {
 				}
 			}
 			if nil != err {
-				response.Error = &rpcError{
-					Code:    rpcInternalError,
-					Message: err.Error(),
+				var rpcErr rpcError
+				if errors.As(err, &rpcErr) {
+					response.Error = &rpcErr
+				} else {
+					response.Error = &rpcError{
+						Code:    rpcInternalError,
+						Message: err.Error(),
+					}
 				}
 			}
 		}
@@ -219,6 +272,49 @@ func (s *server) notify(message string, params any) {
 	}
 }
 
+// request sends a request to the client without waiting for the response
+func (s *server) request(method string, params any) {
+	println("-> " + method)
+
+	if data, err := json.Marshal(params); err == nil {
+		s.requestChan <- rpcCall{
+			Jsonrpc: "2.0",
+			Id:      s.lastRequestId.Add(1),
+			Method:  method,
+			Params:  data,
+		}
+	}
+}
+
+// requestAndWait sends a request to the client and waits for the response, it returns false
+// if the client responded with an error or did not respond in time.
+// Must not be called from the receiver goroutine as it handles responses.
+func (s *server) requestAndWait(method string, params any) (json.RawMessage, bool) {
+	println("-> " + method)
+
+	data, err := json.Marshal(params)
+	if err != nil {
+		return nil, false
+	}
+	id := s.lastRequestId.Add(1)
+	waiter := make(chan rpcResponse, 1)
+	s.locker.Lock()
+	s.responseWaiters[id] = waiter
+	s.locker.Unlock()
+
+	s.requestChan <- rpcCall{Jsonrpc: "2.0", Id: id, Method: method, Params: data}
+
+	select {
+	case response := <-waiter:
+		return response.Result, response.Error == nil
+	case <-time.After(responseTimeout):
+		s.locker.Lock()
+		delete(s.responseWaiters, id)
+		s.locker.Unlock()
+		return nil, false
+	}
+}
+
 func (s *server) reportError(message string) {
 	s.notify("window/showMessage", protocol.ShowMessageParams{
 		Type:    protocol.Error,
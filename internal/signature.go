@@ -0,0 +1,227 @@
+package internal
+
+import (
+	"github.com/nar-lang/nar-compiler/ast"
+	"github.com/nar-lang/nar-compiler/ast/parsed"
+	"github.com/nar-lang/nar-compiler/ast/typed"
+	"github.com/nar-lang/nar-compiler/common"
+	"github.com/nar/internal/protocol"
+	"slices"
+	"strings"
+)
+
+// signatureHelp returns signature of the function which call encloses the cursor.
+// Current text of the document is scanned as the call is usually not compiled yet when it is being typed.
+func (s *server) signatureHelp(uri protocol.DocumentURI, position protocol.Position) *protocol.SignatureHelp {
+	loc, m, ok := s.locationUnderCursor(uri, position.Line, position.Character)
+	if !ok {
+		return nil
+	}
+	text := s.documentText(uri, m)
+	cursor := offsetAt(text, position.Line, position.Character)
+	open, activeParameter, ok := enclosingCall(text, cursor)
+	if !ok {
+		return nil
+	}
+	start, end := calleeIdentifier(text, open)
+	if start == end {
+		return nil
+	}
+
+	signature := s.calleeSignature(loc.FilePath(), text, start, end, m)
+	if signature == nil {
+		return nil
+	}
+	signature.ActiveParameter = activeParameter
+	return &protocol.SignatureHelp{
+		Signatures:      []protocol.SignatureInformation{*signature},
+		ActiveParameter: activeParameter,
+	}
+}
+
+// calleeSignature resolves identifier text[start:end] using typed tree of the module
+// and falls back to lookup by name if the module does not type check at the moment
+func (s *server) calleeSignature(
+	path string, text []rune, start int, end int, m *parsed.Module,
+) *protocol.SignatureInformation {
+	// typed tree can be used only if offsets of the text match the compiled one
+	if slices.Equal(text, m.Location().FileContent()) {
+		identLoc := ast.NewLocationCursor(path, text, uint32(end-1))
+		if _, _, stmt := s.statementAtLocation(identLoc, m); stmt != nil {
+			switch e := stmt.(type) {
+			case *typed.Global:
+				if def := e.Definition(); def != nil {
+					return s.definitionSignatureInfo(def, m.Name())
+				}
+			case *typed.POption:
+				if def := e.Definition(); def != nil {
+					return s.definitionSignatureInfo(def, m.Name())
+				}
+			case *typed.Local:
+				if fn, ok := e.Type().(*typed.TFunc); ok {
+					return funcSignatureInfo(e.Code(m.Name()), fn, m.Name())
+				}
+			}
+		}
+	}
+
+	ident := ast.QualifiedIdentifier(text[start:end])
+	if def, _, _ := m.FindDefinition(s.parsedModules, ident); def != nil {
+		if nDef := def.Successor(); nDef != nil {
+			if tDef, ok := nDef.Successor().(*typed.Definition); ok && tDef != nil {
+				return s.definitionSignatureInfo(tDef, m.Name())
+			}
+		}
+	}
+	return nil
+}
+
+func (s *server) definitionSignatureInfo(
+	def *typed.Definition, currentModule ast.QualifiedIdentifier,
+) *protocol.SignatureInformation {
+	var moduleName ast.QualifiedIdentifier
+	var pDef parsed.Definition
+	if mod := s.moduleOfLocation(def.Location()); mod != nil {
+		moduleName = mod.Name()
+		pDef, _ = common.Find(func(d parsed.Definition) bool { return d.Name() == def.Name() }, mod.Definitions())
+	}
+	label, params := definitionSignatureParts(def, moduleName, pDef, currentModule)
+	info := &protocol.SignatureInformation{
+		Label:      label,
+		Parameters: parameterInfos(params),
+	}
+	if doc := docComment(def.Location()); doc != "" {
+		info.Documentation = &protocol.Or_SignatureInformation_documentation{
+			Value: protocol.MarkupContent{Kind: protocol.Markdown, Value: doc},
+		}
+	}
+	return info
+}
+
+// funcSignatureInfo describes call of a local value of function type (e.g. lambda or function parameter)
+func funcSignatureInfo(
+	name string, fn *typed.TFunc, currentModule ast.QualifiedIdentifier,
+) *protocol.SignatureInformation {
+	sb := strings.Builder{}
+	sb.WriteString(name)
+	sb.WriteString("(")
+	var params []string
+	for i := 0; i < fn.NumParams(); i++ {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		param := fn.ParamAt(i).Code(currentModule)
+		params = append(params, param)
+		sb.WriteString(param)
+	}
+	sb.WriteString(")")
+	sb.WriteString(typeSuffix(fn.Return(), currentModule))
+	return &protocol.SignatureInformation{
+		Label:      sb.String(),
+		Parameters: parameterInfos(params),
+	}
+}
+
+func parameterInfos(params []string) []protocol.ParameterInformation {
+	var infos []protocol.ParameterInformation
+	for _, p := range params {
+		infos = append(infos, protocol.ParameterInformation{Label: p})
+	}
+	return infos
+}
+
+// calleeIdentifier returns bounds of the identifier right before the opening parenthesis of a call
+func calleeIdentifier(text []rune, open int) (int, int) {
+	end := open
+	for end > 0 && (text[end-1] == ' ' || text[end-1] == '\t') {
+		end--
+	}
+	start := end
+	for start > 0 && isIdentChar(text[start-1]) {
+		start--
+	}
+	return start, end
+}
+
+// enclosingCall scans text backwards from the cursor and returns position of the unmatched
+// opening parenthesis and index of the argument under the cursor.
+// Parentheses and commas inside of string and char literals and comments are skipped.
+func enclosingCall(text []rune, cursor int) (int, uint32, bool) {
+	if cursor > len(text) {
+		cursor = len(text)
+	}
+	code := codeMask(text[:cursor])
+	depth := 0
+	var commas uint32
+	for i := cursor - 1; i >= 0; i-- {
+		if !code[i] {
+			continue
+		}
+		switch text[i] {
+		case ')', ']', '}':
+			depth++
+		case '[', '{':
+			if depth == 0 {
+				// cursor is inside a list or record literal passed as an argument
+				commas = 0
+			} else {
+				depth--
+			}
+		case '(':
+			if depth == 0 {
+				return i, commas, true
+			}
+			depth--
+		case ',':
+			if depth == 0 {
+				commas++
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// codeMask marks runes of the text that are not inside of string or char literals and comments
+func codeMask(text []rune) []bool {
+	code := make([]bool, len(text))
+	at := func(i int, seq string) bool {
+		return strings.HasPrefix(string(text[i:min(i+len(seq), len(text))]), seq)
+	}
+	for i := 0; i < len(text); {
+		switch {
+		case at(i, "//"):
+			for i < len(text) && text[i] != '\n' {
+				i++
+			}
+		case at(i, "/*"):
+			// block comments can be nested
+			depth := 0
+			for i < len(text) {
+				if at(i, "/*") {
+					depth++
+					i += 2
+				} else if at(i, "*/") {
+					depth--
+					i += 2
+					if depth == 0 {
+						break
+					}
+				} else {
+					i++
+				}
+			}
+		case text[i] == '"' || text[i] == '\'':
+			quote := text[i]
+			for i++; i < len(text) && text[i] != quote && text[i] != '\n'; i++ {
+				if text[i] == '\\' {
+					i++
+				}
+			}
+			i++
+		default:
+			code[i] = true
+			i++
+		}
+	}
+	return code
+}
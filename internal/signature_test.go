@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEnclosingCall(t *testing.T) {
+	tests := []struct {
+		name string
+		// text has `|` at the cursor position and `^` at the expected opening parenthesis
+		text     string
+		argument uint32
+		found    bool
+	}{
+		{name: "first argument", text: "f^(|", found: true},
+		{name: "second argument", text: "f^(a, |", argument: 1, found: true},
+		{name: "nested call is skipped", text: "f^(g(a, b), |", argument: 1, found: true},
+		{name: "inside nested call", text: "f(a, g^(b, |", argument: 1, found: true},
+		{name: "inside list argument", text: "f^(a, [1, 2, |", argument: 1, found: true},
+		{name: "after list argument", text: "f^(a, [1, 2], |", argument: 2, found: true},
+		{name: "comma in string", text: `f^("a, b", |`, argument: 1, found: true},
+		{name: "parenthesis in char", text: `f^(')', |`, argument: 1, found: true},
+		{name: "parenthesis in line comment", text: "f^(a, // (\n|", argument: 1, found: true},
+		{name: "nested block comment", text: "f^(a /* ( /* , */ , */, |", argument: 1, found: true},
+		{name: "closed call", text: "f(a, b) |"},
+		{name: "no call", text: "a|"},
+		{name: "cursor after the end is clamped", text: "f^(a, b", argument: 1, found: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text := tt.text
+			open := strings.IndexRune(text, '^')
+			text = strings.Replace(text, "^", "", 1)
+			cursor := strings.IndexRune(text, '|')
+			if cursor < 0 {
+				cursor = len(text) + 1
+			} else {
+				text = strings.Replace(text, "|", "", 1)
+			}
+			pos, argument, found := enclosingCall([]rune(text), cursor)
+			if found != tt.found {
+				t.Fatalf("found is %v, expected %v", found, tt.found)
+			}
+			if !found {
+				return
+			}
+			if pos != open || argument != tt.argument {
+				t.Errorf("call at %d with argument %d, expected call at %d with argument %d", pos, argument, open, tt.argument)
+			}
+		})
+	}
+}
+
+func TestCodeMask(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		// mask has `x` for code runes and `_` for others
+		mask string
+	}{
+		{name: "code", text: "a(b)", mask: "xxxx"},
+		{name: "string", text: `a"b,c"d`, mask: "x_____x"},
+		{name: "escaped quote", text: `"a\"b"c`, mask: "______x"},
+		{name: "char", text: `'('a`, mask: "___x"},
+		{name: "unterminated string ends at line end", text: "\"ab\nc", mask: "____x"},
+		{name: "line comment", text: "a// b\nc", mask: "x____xx"},
+		{name: "block comment", text: "a/* b */c", mask: "x_______x"},
+		{name: "nested block comment", text: "/*/**/*/a", mask: "________x"},
+		{name: "unterminated block comment", text: "a/* b", mask: "x____"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mask strings.Builder
+			for _, code := range codeMask([]rune(tt.text)) {
+				if code {
+					mask.WriteRune('x')
+				} else {
+					mask.WriteRune('_')
+				}
+			}
+			if mask.String() != tt.mask {
+				t.Errorf("mask is %s, expected %s", mask.String(), tt.mask)
+			}
+		})
+	}
+}
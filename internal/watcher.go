@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"github.com/nar-lang/nar-compiler/ast"
+	"github.com/nar/internal/protocol"
+	"path/filepath"
+	"strings"
+)
+
+// registerFileWatchers asks the client to notify about sources and package files changed outside the editor
+func (s *server) registerFileWatchers() {
+	s.request("client/registerCapability", protocol.RegistrationParams{
+		Registrations: []protocol.Registration{
+			{
+				ID:     "nar/watchedFiles",
+				Method: "workspace/didChangeWatchedFiles",
+				RegisterOptions: protocol.DidChangeWatchedFilesRegistrationOptions{
+					Watchers: []protocol.FileSystemWatcher{
+						{GlobPattern: "**/*.nar"},
+						{GlobPattern: "**/nar.json"},
+					},
+				},
+			},
+		},
+	})
+}
+
+// watchedFilesChanged invalidates packages of changed files and recompiles them.
+// Changes of opened documents are ignored as their content is provided by the client.
+func (s *server) watchedFilesChanged(changes []protocol.FileEvent) {
+	s.locker.Lock()
+	var changed []protocol.DocumentURI
+	for _, change := range changes {
+		if _, opened := s.openedDocuments[change.URI]; opened {
+			continue
+		}
+		path := uriToPath(change.URI)
+		if filepath.Base(path) == "nar.json" {
+			root := filepath.Dir(path)
+			if pvd, ok := s.provides[root]; ok {
+				pvd.Invalidate()
+				if packages, err := pvd.ExportedPackages(); err == nil && len(packages) == 1 {
+					s.packageRootToName[root] = ast.PackageIdentifier(packages[0].Info().Name)
+				}
+			}
+			// package info affects every module of the package
+			for modulePath := range s.index.paths {
+				if strings.HasPrefix(modulePath, root+string(filepath.Separator)) {
+					changed = append(changed, pathToUri(modulePath))
+				}
+			}
+		} else if pvd, ok := s.provides[findPackageRoot(path)]; ok {
+			pvd.Invalidate()
+		}
+		changed = append(changed, change.URI)
+	}
+	s.locker.Unlock()
+
+	for _, uri := range changed {
+		s.compileChan <- docChange{uri: uri, force: true}
+	}
+}